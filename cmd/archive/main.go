@@ -0,0 +1,24 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"ronald-destroyer/ronnyd"
+)
+
+// Downloads attachments that were stored before archiving was turned on
+func main() {
+	limit := flag.Int("limit", 1000, "Maximum number of attachments to download")
+	flag.Parse()
+
+	db := ronnyd.ConnectToDB()
+	store := ronnyd.OpenBlobStore()
+	if store == nil {
+		panic("BLOB_STORE_PATH is not configured")
+	}
+	archived, err := ronnyd.ArchivePendingAttachments(db, store, ronnyd.AttachmentClient, *limit)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Archived", archived, "attachments")
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"ronald-destroyer/ronnyd"
+)
+
+// One-off migration from duplicate message rows per edit to message revisions
+func main() {
+	db := ronnyd.ConnectToDB()
+	db.AutoMigrate(&ronnyd.Message{}, &ronnyd.MessageRevision{})
+
+	folded, err := ronnyd.FoldDuplicateMessages(db)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Folded", folded, "edited messages into revisions")
+
+	backfilled, err := ronnyd.BackfillMessageRevisions(db)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Backfilled", backfilled, "original revisions")
+}
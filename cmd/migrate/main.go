@@ -7,5 +7,23 @@ import (
 func main() {
 	db := ronnyd.ConnectToDB()
 	db.Debug()
-	db.AutoMigrate(&ronnyd.Author{}, &ronnyd.Channel{}, &ronnyd.Message{})
+	db.AutoMigrate(
+		&ronnyd.Author{},
+		&ronnyd.AuthorHistory{},
+		&ronnyd.Channel{},
+		&ronnyd.Message{},
+		&ronnyd.ScrapeState{},
+		&ronnyd.MessageRevision{},
+		&ronnyd.Attachment{},
+		&ronnyd.Embed{},
+		&ronnyd.Sticker{},
+		&ronnyd.Reaction{},
+		&ronnyd.ReactionUser{},
+		&ronnyd.Guild{},
+		&ronnyd.PlaybackCooldown{},
+		&ronnyd.PlaybackRun{},
+		&ronnyd.PlaybackItem{},
+		&ronnyd.PlaybackSession{},
+		&ronnyd.PlaybackWebhook{},
+	)
 }
@@ -2,25 +2,156 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"os"
 	"ronald-destroyer/ronnyd"
+	"strings"
 )
 
 func main() {
 	ronnyd.LoadConfig()
-	playbackTarget := flag.String(
+	if len(os.Args) > 1 && os.Args[1] == "runs" {
+		listRuns(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "sessions" {
+		listSessions(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "undo" {
+		undoRun(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		runPlayback(os.Args[2:])
+		return
+	}
+	runPlayback(os.Args[1:])
+}
+
+func runPlayback(args []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	playbackTarget := flags.String(
 		"target",
 		os.Getenv("ADMIN_DISCORD_ID"),
 		"Target user (discord_id) to playback messages for",
 	)
-	flag.Parse()
+	guildID := flags.String(
+		"guild",
+		"",
+		"Only replay messages from this guild (discord_id), using its settings",
+	)
+	grouping := flags.String(
+		"grouping",
+		"",
+		"How to split messages into sessions, one of "+strings.Join(ronnyd.SESSION_GROUPINGS, ", "),
+	)
+	selection := flags.String(
+		"selection",
+		"",
+		"Which session to replay, one of "+strings.Join(ronnyd.SESSION_SELECTIONS, ", "),
+	)
+	seed := flags.Int64("seed", 0, "Seed for random selections, so the same session is picked each time")
+	sessionID := flags.Uint("session", 0, "Replay this session from the sessions list, instead of picking one")
+	destination := flags.String("destination", "", "Channel (discord_id) to replay into, instead of where the session was")
+	memoryLane := flags.Bool("memory-lane", false, "Replay into a new thread in the destination")
+	flags.Parse(args)
 	d, err := ronnyd.InitDiscordSession()
 	if err != nil {
 		panic(err)
 	}
 
-	ronnyd.RunPlayback(
-		d,
-		*playbackTarget,
-	)
+	db := ronnyd.ConnectToDB()
+	guild, err := ronnyd.GetGuildSettings(db, *guildID)
+	if err != nil {
+		panic(err)
+	}
+	request := &ronnyd.PlaybackRequest{
+		TargetID:  *playbackTarget,
+		Guild:     guild,
+		Grouping:  *grouping,
+		Selection: *selection,
+		Seed:      *seed,
+
+		DestinationChannelID: *destination,
+		MemoryLane:           *memoryLane,
+	}
+	if *sessionID != 0 {
+		session := ronnyd.GetPlaybackSession(db, *sessionID)
+		if session == nil {
+			fmt.Println("No session", *sessionID)
+			os.Exit(1)
+		}
+		request.TargetID = session.Author.DiscordID
+		request.SessionID = session.ID
+	}
+	run, err := ronnyd.RunPlaybackRequest(d, db, request)
+	if run != nil {
+		fmt.Println(run.Summary())
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func listRuns(args []string) {
+	flags := flag.NewFlagSet("runs", flag.ExitOnError)
+	guildID := flags.String("guild", "", "Only list playbacks in this guild (discord_id)")
+	limit := flags.Int("limit", ronnyd.PLAYBACK_RUNS_TO_LIST, "How many playbacks to list")
+	flags.Parse(args)
+
+	db := ronnyd.ConnectToDB()
+	fmt.Println(ronnyd.FormatPlaybackRuns(ronnyd.GetPlaybackRuns(db, *guildID, *limit)))
+}
+
+func listSessions(args []string) {
+	flags := flag.NewFlagSet("sessions", flag.ExitOnError)
+	target := flags.String("target", os.Getenv("ADMIN_DISCORD_ID"), "User (discord_id) to list sessions for")
+	guildID := flags.String("guild", "", "Guild (discord_id) the sessions are in")
+	limit := flags.Int("limit", ronnyd.PLAYBACK_SESSIONS_TO_LIST, "How many sessions to list")
+	flags.Parse(args)
+
+	db := ronnyd.ConnectToDB()
+	author := ronnyd.GetAuthor(db, *target)
+	if author == nil {
+		fmt.Println("No messages from", *target)
+		os.Exit(1)
+	}
+	guild, err := ronnyd.GetGuildSettings(db, *guildID)
+	if err != nil {
+		panic(err)
+	}
+	err = ronnyd.EnsurePlaybackSessions(db, guild, author.ID)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(ronnyd.FormatPlaybackSessions(ronnyd.GetPlaybackSessions(db, *guildID, author.ID, *limit)))
+}
+
+func undoRun(args []string) {
+	flags := flag.NewFlagSet("undo", flag.ExitOnError)
+	runID := flags.Uint("run", 0, "The playback to undo, the guild's latest when not given")
+	guildID := flags.String("guild", "", "Guild (discord_id) to undo the latest playback in")
+	flags.Parse(args)
+
+	db := ronnyd.ConnectToDB()
+	var run *ronnyd.PlaybackRun
+	if *runID != 0 {
+		run = ronnyd.GetPlaybackRun(db, *runID)
+	} else {
+		run = ronnyd.GetLatestPlaybackRun(db, *guildID)
+	}
+	if run == nil {
+		fmt.Println("No playback to undo")
+		os.Exit(1)
+	}
+	d, err := ronnyd.InitDiscordSession()
+	if err != nil {
+		panic(err)
+	}
+	deleted, err := ronnyd.UndoPlaybackRun(d, db, run)
+	fmt.Println("Deleted", deleted, "messages from playback", run.ID)
+	if err != nil {
+		panic(err)
+	}
 }
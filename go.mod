@@ -3,7 +3,7 @@ module ronald-destroyer
 go 1.18
 
 require (
-	github.com/bwmarrin/discordgo v0.26.1
+	github.com/bwmarrin/discordgo v0.28.1
 	github.com/joho/godotenv v1.4.0
 	github.com/stretchr/testify v1.8.1
 	gorm.io/driver/postgres v1.4.5
@@ -0,0 +1,257 @@
+package ronnyd
+
+import (
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+const STICKER_CDN_URL = "https://media.discordapp.net/stickers/"
+
+type Attachment struct {
+	gorm.Model
+	MessageID   uint   `gorm:"index"`
+	DiscordID   string `gorm:"index"`
+	Filename    string
+	URL         string
+	ProxyURL    string
+	Size        int
+	ContentType string
+	Width       int
+	Height      int
+	// sha256 of the downloaded file in the BlobStore, empty until archived
+	BlobHash string `gorm:"index"`
+}
+
+type Embed struct {
+	gorm.Model
+	MessageID    uint `gorm:"index"`
+	Position     int
+	Type         string
+	Title        string
+	Description  string
+	URL          string
+	ImageURL     string
+	ThumbnailURL string
+	VideoURL     string
+	Width        int
+	Height       int
+}
+
+type Sticker struct {
+	gorm.Model
+	MessageID  uint `gorm:"index"`
+	DiscordID  string
+	Name       string
+	FormatType int
+}
+
+func (sticker *Sticker) URL() string {
+	if discordgo.StickerFormat(sticker.FormatType) == discordgo.StickerFormatTypeLottie {
+		return STICKER_CDN_URL + sticker.DiscordID + ".json"
+	}
+	return STICKER_CDN_URL + sticker.DiscordID + ".png"
+}
+
+// persistMessageAssets brings the attachments, embeds and stickers we have
+// stored for the message in line with discord's. Rows are updated in place so
+// archived attachments keep their BlobHash, and only what discord no longer
+// reports is deleted. Discord leaves these out of partial updates, so a nil
+// slice means unchanged rather than removed.
+func persistMessageAssets(tx *gorm.DB, message *Message, msg *discordgo.Message) error {
+	if msg.Attachments != nil {
+		err := persistAttachments(tx, message, msg.Attachments)
+		if err != nil {
+			return err
+		}
+	}
+	if msg.Embeds != nil {
+		err := persistEmbeds(tx, message, msg.Embeds)
+		if err != nil {
+			return err
+		}
+	}
+	if msg.StickerItems != nil {
+		err := persistStickers(tx, message, msg.StickerItems)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func persistAttachments(tx *gorm.DB, message *Message, attachments []*discordgo.MessageAttachment) error {
+	var stored []*Attachment
+	result := tx.Where("message_id = ?", message.ID).Find(&stored)
+	if result.Error != nil {
+		return result.Error
+	}
+	existing := make(map[string]*Attachment, len(stored))
+	for _, attachment := range stored {
+		existing[attachment.DiscordID] = attachment
+	}
+	for _, attachment := range attachments {
+		row, ok := existing[attachment.ID]
+		if !ok {
+			row = &Attachment{MessageID: message.ID, DiscordID: attachment.ID}
+		}
+		delete(existing, attachment.ID)
+		row.Filename = attachment.Filename
+		row.URL = attachment.URL
+		row.ProxyURL = attachment.ProxyURL
+		row.Size = attachment.Size
+		row.ContentType = attachment.ContentType
+		row.Width = attachment.Width
+		row.Height = attachment.Height
+		result = tx.Save(row)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	for _, removed := range existing {
+		result = tx.Unscoped().Delete(removed)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+// Embeds don't have IDs, so they're matched up by position
+func persistEmbeds(tx *gorm.DB, message *Message, embeds []*discordgo.MessageEmbed) error {
+	var stored []*Embed
+	result := tx.Where("message_id = ?", message.ID).Find(&stored)
+	if result.Error != nil {
+		return result.Error
+	}
+	existing := make(map[int]*Embed, len(stored))
+	for _, embed := range stored {
+		existing[embed.Position] = embed
+	}
+	for i, embed := range embeds {
+		row, ok := existing[i]
+		if !ok {
+			row = &Embed{MessageID: message.ID, Position: i}
+		}
+		delete(existing, i)
+		row.Type = string(embed.Type)
+		row.Title = embed.Title
+		row.Description = embed.Description
+		row.URL = embed.URL
+		row.ImageURL, row.ThumbnailURL, row.VideoURL = "", "", ""
+		row.Width, row.Height = 0, 0
+		if embed.Image != nil {
+			row.ImageURL = embed.Image.URL
+			row.Width = embed.Image.Width
+			row.Height = embed.Image.Height
+		}
+		if embed.Thumbnail != nil {
+			row.ThumbnailURL = embed.Thumbnail.URL
+		}
+		if embed.Video != nil {
+			row.VideoURL = embed.Video.URL
+			row.Width = embed.Video.Width
+			row.Height = embed.Video.Height
+		}
+		result = tx.Save(row)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	for _, removed := range existing {
+		result = tx.Unscoped().Delete(removed)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+func persistStickers(tx *gorm.DB, message *Message, stickers []*discordgo.StickerItem) error {
+	var stored []*Sticker
+	result := tx.Where("message_id = ?", message.ID).Find(&stored)
+	if result.Error != nil {
+		return result.Error
+	}
+	existing := make(map[string]*Sticker, len(stored))
+	for _, sticker := range stored {
+		existing[sticker.DiscordID] = sticker
+	}
+	for _, sticker := range stickers {
+		row, ok := existing[sticker.ID]
+		if !ok {
+			row = &Sticker{MessageID: message.ID, DiscordID: sticker.ID}
+		}
+		delete(existing, sticker.ID)
+		row.Name = sticker.Name
+		row.FormatType = int(sticker.FormatType)
+		result = tx.Save(row)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	for _, removed := range existing {
+		result = tx.Unscoped().Delete(removed)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
+// UpdateMessageEmbeds handles the updates discord sends once it has resolved
+// the embeds for links in a message, which come without an author
+func UpdateMessageEmbeds(db *gorm.DB, msg *discordgo.Message) error {
+	var existingMessage Message
+	db.Limit(1).Find(&existingMessage, "discord_id = ?", msg.ID)
+	if existingMessage.ID == 0 {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		return persistMessageAssets(tx, &existingMessage, msg)
+	})
+}
+
+// PlaybackContent is what we send when replaying a message. Attachments,
+// stickers and rich embeds are added as links since we can't post them as
+// the original author.
+func PlaybackContent(message *Message) string {
+	return playbackContent(message, nil)
+}
+
+func playbackContent(message *Message, reuploaded map[uint]bool) string {
+	lines := make([]string, 0, 1+len(message.Attachments)+len(message.Stickers)+len(message.Embeds))
+	if message.Content != "" {
+		lines = append(lines, message.Content)
+	}
+	for _, attachment := range message.Attachments {
+		if reuploaded[attachment.ID] {
+			continue
+		}
+		lines = append(lines, attachment.URL)
+	}
+	for _, sticker := range message.Stickers {
+		lines = append(lines, sticker.URL())
+	}
+	for _, embed := range message.Embeds {
+		// Link embeds unfurl again from the url in the content
+		if embed.Type != string(discordgo.EmbedTypeRich) {
+			continue
+		}
+		switch {
+		case embed.URL != "" && !strings.Contains(message.Content, embed.URL):
+			lines = append(lines, embed.Title+" "+embed.URL)
+		case embed.ImageURL != "":
+			lines = append(lines, embed.ImageURL)
+		case embed.Title != "":
+			lines = append(lines, embed.Title)
+		}
+	}
+	content := strings.TrimSpace(strings.Join(lines, "\n"))
+	quote := replyQuote(message)
+	if content != "" && quote != "" {
+		content = quote + "\n" + content
+	}
+	return content
+}
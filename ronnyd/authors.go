@@ -0,0 +1,149 @@
+package ronnyd
+
+import (
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+// AuthorHistory is a snapshot of an author's profile, recorded whenever we
+// notice it change
+type AuthorHistory struct {
+	gorm.Model
+	AuthorID uint `gorm:"index"`
+	// Only set when we saw the author's guild member details, since
+	// nicknames are per guild
+	GuildID       string `gorm:"index"`
+	Name          string
+	Discriminator string
+	Avatar        string
+	GlobalName    string
+	Nickname      string
+	ObservedAt    time.Time
+}
+
+// PersistAuthorProfile stores the author if we haven't seen them before, and
+// brings their profile up to date if we have. Member is optional, without it
+// we leave nicknames alone.
+func PersistAuthorProfile(db *gorm.DB, user *discordgo.User, member *discordgo.Member, guildID string) (*Author, error) {
+	var existingAuthor Author
+	db.Limit(1).Find(&existingAuthor, "discord_id = ?", user.ID)
+	if existingAuthor.ID != 0 {
+		return &existingAuthor, updateAuthorProfile(db, &existingAuthor, user, member, guildID)
+	}
+
+	newAuthor := &Author{
+		Name:          user.Username,
+		Discriminator: user.Discriminator,
+		DiscordID:     user.ID,
+		Avatar:        user.Avatar,
+		GlobalName:    user.GlobalName,
+	}
+	if member != nil {
+		newAuthor.Nickname = member.Nick
+	}
+	result := db.Create(newAuthor)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return newAuthor, recordAuthorHistory(db, newAuthor, member, guildID)
+}
+
+// UpdateKnownAuthorProfile updates the profile of an author we've already
+// stored, we don't want to start tracking everyone in the guild
+func UpdateKnownAuthorProfile(db *gorm.DB, user *discordgo.User, member *discordgo.Member, guildID string) error {
+	var existingAuthor Author
+	db.Limit(1).Find(&existingAuthor, "discord_id = ?", user.ID)
+	if existingAuthor.ID == 0 {
+		return nil
+	}
+	return updateAuthorProfile(db, &existingAuthor, user, member, guildID)
+}
+
+func updateAuthorProfile(db *gorm.DB, author *Author, user *discordgo.User, member *discordgo.Member, guildID string) error {
+	if user.Username == "" {
+		// Partial user, nothing to compare against
+		return nil
+	}
+	changed := author.Name != user.Username ||
+		author.Discriminator != user.Discriminator ||
+		author.GlobalName != user.GlobalName
+	if user.Avatar != "" && user.Avatar != author.Avatar {
+		changed = true
+	}
+	if member != nil && member.Nick != guildNickname(db, author.ID, guildID) {
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+
+	author.Name = user.Username
+	author.Discriminator = user.Discriminator
+	author.GlobalName = user.GlobalName
+	if user.Avatar != "" {
+		author.Avatar = user.Avatar
+	}
+	if member != nil {
+		author.Nickname = member.Nick
+	}
+	result := db.Save(author)
+	if result.Error != nil {
+		return result.Error
+	}
+	return recordAuthorHistory(db, author, member, guildID)
+}
+
+func recordAuthorHistory(db *gorm.DB, author *Author, member *discordgo.Member, guildID string) error {
+	history := &AuthorHistory{
+		AuthorID:      author.ID,
+		Name:          author.Name,
+		Discriminator: author.Discriminator,
+		Avatar:        author.Avatar,
+		GlobalName:    author.GlobalName,
+		ObservedAt:    time.Now(),
+	}
+	if member != nil {
+		history.GuildID = guildID
+		history.Nickname = member.Nick
+	}
+	return db.Create(history).Error
+}
+
+// GetAuthorNickname is what the author goes by in the guild: their latest
+// known nickname there, or failing that their global display name
+func GetAuthorNickname(db *gorm.DB, authorID uint, guildID string) string {
+	nickname := guildNickname(db, authorID, guildID)
+	if nickname != "" {
+		return nickname
+	}
+	var author Author
+	db.Limit(1).Find(&author, authorID)
+	return author.GlobalName
+}
+
+func guildNickname(db *gorm.DB, authorID uint, guildID string) string {
+	var history AuthorHistory
+	db.Where(
+		"author_id = ? AND guild_id = ?", authorID, guildID,
+	).Order("observed_at desc").Limit(1).Find(&history)
+	return history.Nickname
+}
+
+func GetAuthorHistory(db *gorm.DB, authorID uint) []*AuthorHistory {
+	var history []*AuthorHistory
+	db.Order("observed_at").Find(&history, "author_id = ?", authorID)
+	return history
+}
+
+// GetAuthor finds a stored author by their discord ID, nil if we've never
+// seen them
+func GetAuthor(db *gorm.DB, discordID string) *Author {
+	var author Author
+	db.Limit(1).Find(&author, "discord_id = ?", discordID)
+	if author.ID == 0 {
+		return nil
+	}
+	return &author
+}
@@ -0,0 +1,218 @@
+package ronnyd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+// BlobStore holds archived files addressed by the sha256 of their contents,
+// so the same upload posted in several messages is only stored once
+type BlobStore interface {
+	Put(r io.Reader) (string, error)
+	Open(hash string) (io.ReadCloser, error)
+	Has(hash string) bool
+}
+
+var AttachmentClient = &http.Client{Timeout: 2 * time.Minute}
+
+type LocalBlobStore struct {
+	Root string
+}
+
+func NewLocalBlobStore(root string) (*LocalBlobStore, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalBlobStore{Root: root}, nil
+}
+
+// OpenBlobStore returns the store configured by BLOB_STORE_PATH, or nil when
+// attachments aren't being archived
+func OpenBlobStore() BlobStore {
+	LoadConfig()
+	root := os.Getenv("BLOB_STORE_PATH")
+	if root == "" {
+		return nil
+	}
+	store, err := NewLocalBlobStore(root)
+	if err != nil {
+		log.Default().Println("Unable to open blob store", root, err)
+		return nil
+	}
+	return store
+}
+
+func (store *LocalBlobStore) path(hash string) string {
+	// Shard by prefix so we don't end up with one enormous directory
+	return filepath.Join(store.Root, hash[:2], hash)
+}
+
+func (store *LocalBlobStore) Put(r io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(store.Root, "upload-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hasher), r)
+	closeErr := tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	if closeErr != nil {
+		return "", closeErr
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if store.Has(hash) {
+		return hash, nil
+	}
+	err = os.MkdirAll(filepath.Dir(store.path(hash)), 0755)
+	if err != nil {
+		return "", err
+	}
+	return hash, os.Rename(tmp.Name(), store.path(hash))
+}
+
+func (store *LocalBlobStore) Open(hash string) (io.ReadCloser, error) {
+	if len(hash) != sha256.Size*2 {
+		return nil, fmt.Errorf("invalid blob hash %q", hash)
+	}
+	return os.Open(store.path(hash))
+}
+
+func (store *LocalBlobStore) Has(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := os.Stat(store.path(hash))
+	return err == nil
+}
+
+// ArchiveAttachment downloads the attachment from discord's CDN into the blob
+// store, unless we already have its contents
+func ArchiveAttachment(db *gorm.DB, store BlobStore, client *http.Client, attachment *Attachment) error {
+	if attachment.BlobHash != "" && store.Has(attachment.BlobHash) {
+		return nil
+	}
+
+	// The same upload shows up again when a message is edited or rescraped
+	var archived Attachment
+	db.Where(
+		"discord_id = ? AND blob_hash != ''", attachment.DiscordID,
+	).Limit(1).Find(&archived)
+	if archived.ID != 0 && store.Has(archived.BlobHash) {
+		return db.Model(attachment).Update("blob_hash", archived.BlobHash).Error
+	}
+
+	resp, err := client.Get(attachment.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to download attachment %s: %s", attachment.DiscordID, resp.Status)
+	}
+	hash, err := store.Put(resp.Body)
+	if err != nil {
+		return err
+	}
+	return db.Model(attachment).Update("blob_hash", hash).Error
+}
+
+func ArchiveMessageAttachments(db *gorm.DB, store BlobStore, client *http.Client, message *Message) error {
+	var lastErr error
+	for i := range message.Attachments {
+		err := ArchiveAttachment(db, store, client, &message.Attachments[i])
+		if err != nil {
+			log.Default().Println("Error archiving attachment", message.Attachments[i].DiscordID, err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// ArchiveNewMessage archives a freshly persisted message's attachments in the
+// background, if there is a blob store configured
+func ArchiveNewMessage(db *gorm.DB, message *Message) {
+	store := OpenBlobStore()
+	if store == nil || message == nil {
+		return
+	}
+	go func() {
+		var attachments []Attachment
+		db.Find(&attachments, "message_id = ?", message.ID)
+		message.Attachments = attachments
+		ArchiveMessageAttachments(db, store, AttachmentClient, message)
+	}()
+}
+
+// ArchivePendingAttachments archives up to limit attachments that haven't
+// been downloaded yet, oldest first
+func ArchivePendingAttachments(db *gorm.DB, store BlobStore, client *http.Client, limit int) (int, error) {
+	var attachments []*Attachment
+	result := db.Where("blob_hash = ''").Order("id").Limit(limit).Find(&attachments)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	archived := 0
+	for _, attachment := range attachments {
+		err := ArchiveAttachment(db, store, client, attachment)
+		if err != nil {
+			log.Default().Println("Error archiving attachment", attachment.DiscordID, err)
+			continue
+		}
+		archived++
+	}
+	return archived, nil
+}
+
+// playbackMessageSend builds the message to send when replaying, re-uploading
+// any attachments we have archived instead of linking to the CDN
+func playbackMessageSend(store BlobStore, message *Message) *discordgo.MessageSend {
+	data := &discordgo.MessageSend{
+		// Replaying a message shouldn't ping everyone it mentioned all over again
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	}
+	reuploaded := make(map[uint]bool)
+	if store != nil {
+		for _, attachment := range message.Attachments {
+			if attachment.BlobHash == "" {
+				continue
+			}
+			reader, err := store.Open(attachment.BlobHash)
+			if err != nil {
+				log.Default().Println("Unable to open archived attachment", attachment.DiscordID, err)
+				continue
+			}
+			data.Files = append(data.Files, &discordgo.File{
+				Name:        attachment.Filename,
+				ContentType: attachment.ContentType,
+				Reader:      reader,
+			})
+			reuploaded[attachment.ID] = true
+		}
+	}
+	data.Content = playbackContent(message, reuploaded)
+	return data
+}
+
+func closePlaybackFiles(data *discordgo.MessageSend) {
+	for _, file := range data.Files {
+		if closer, ok := file.Reader.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
@@ -3,17 +3,20 @@ package ronnyd
 import (
 	"fmt"
 	"log"
-	"math"
 	"os"
 	"os/signal"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
 
 const INDEX_COMMAND = "index!"
 const DEFAULT_MESSAGES_TO_INDEX = 250
+const DELETED_MESSAGES_TO_LIST = 10
+
+// How far back to look for an audit log entry explaining a deletion
+const MODERATOR_DELETE_WINDOW = 5 * time.Minute
 
 func StartBot() error {
 	fmt.Println("Starting bot")
@@ -24,8 +27,24 @@ func StartBot() error {
 	}
 
 	bot.AddHandler(ReadyHandler)
+	bot.AddHandler(ResumedHandler)
 	bot.AddHandler(MessageHandler)
 	bot.AddHandler(EditHandler)
+	bot.AddHandler(DeleteHandler)
+	bot.AddHandler(BulkDeleteHandler)
+	bot.AddHandler(ReactionAddHandler)
+	bot.AddHandler(ReactionRemoveHandler)
+	bot.AddHandler(ReactionRemoveAllHandler)
+	bot.AddHandler(ThreadCreateHandler)
+	bot.AddHandler(ThreadUpdateHandler)
+	bot.AddHandler(MemberUpdateHandler)
+	bot.AddHandler(UserUpdateHandler)
+	bot.AddHandler(InteractionCreateHandler)
+	if os.Getenv("ENABLE_GUILD_MEMBERS_INTENT") == "true" {
+		// Privileged, so it has to be turned on for the bot in the developer
+		// portal first. Without it we only see nickname changes on messages.
+		bot.Identify.Intents |= discordgo.IntentGuildMembers
+	}
 	err = bot.Open()
 	if err != nil {
 		return err
@@ -53,30 +72,17 @@ func InitDiscordSession() (*discordgo.Session, error) {
 
 func ReadyHandler(s *discordgo.Session, r *discordgo.Ready) {
 	fmt.Println("Bot is ready")
+	err := RegisterApplicationCommands(s)
+	if err != nil {
+		log.Default().Println("Unable to register slash commands", err)
+	}
+	resumeAndNotify(s)
+	catchUpAndNotify(s)
 }
 
-func ScrapeChannelForMessages(s *discordgo.Session, channelID string, maxMessages int, anchorMessageId string) error {
-	db := ConnectToDB()
-	messagesPersisted := 0
-	for messagesPersisted < maxMessages {
-		messages, err := s.ChannelMessages(
-			channelID,
-			int(math.Min(float64(maxMessages-messagesPersisted), 100)),
-			anchorMessageId, "", "")
-		if err != nil {
-			return err
-		}
-		for _, message := range messages {
-			persistedMessage, err := PersistMessageToDb(db, message)
-			if err != nil {
-				return err
-			} else {
-				messagesPersisted++
-				anchorMessageId = persistedMessage.DiscordID
-			}
-		}
-	}
-	return nil
+func ResumedHandler(s *discordgo.Session, r *discordgo.Resumed) {
+	fmt.Println("Bot resumed")
+	catchUpAndNotify(s)
 }
 
 func IsIndexCommand(content string, authorID string) bool {
@@ -95,8 +101,12 @@ func EditHandler(s *discordgo.Session, m *discordgo.MessageUpdate) {
 		m.Message.EditedTimestamp,
 	)
 	if m.Message.Author == nil {
-		// Sometimes we get blank updates from no author, suspect it has
-		// something to do with discord media embeds
+		// Updates without an author are discord filling in the embeds for
+		// links in the message
+		err := UpdateMessageEmbeds(ConnectToDB(), m.Message)
+		if err != nil {
+			log.Default().Println(err)
+		}
 		return
 	}
 	if m.Message.Author.ID == s.State.User.ID {
@@ -110,47 +120,219 @@ func EditHandler(s *discordgo.Session, m *discordgo.MessageUpdate) {
 	}
 }
 
+// The gateway doesn't tell us who deleted a message, but deleting someone
+// else's message shows up in the audit log. Only a best guess, since we need
+// permission to view the audit log and discord merges repeated entries.
+func deletedByModerator(s *discordgo.Session, guildID string, channelID string, authorID string) bool {
+	if guildID == "" || authorID == "" {
+		return false
+	}
+	auditLog, err := s.GuildAuditLog(guildID, "", "", int(discordgo.AuditLogActionMessageDelete), 25)
+	if err != nil {
+		log.Default().Println("Unable to read audit log", guildID, err)
+		return false
+	}
+	for _, entry := range auditLog.AuditLogEntries {
+		if entry.TargetID != authorID || entry.Options == nil || entry.Options.ChannelID != channelID {
+			continue
+		}
+		createdAt, err := discordgo.SnowflakeTimestamp(entry.ID)
+		if err == nil && time.Since(createdAt) < MODERATOR_DELETE_WINDOW {
+			return true
+		}
+	}
+	return false
+}
+
+func DeleteHandler(s *discordgo.Session, m *discordgo.MessageDelete) {
+	log.Default().Println("Message Delete", m.ID, m.ChannelID)
+	db := ConnectToDB()
+	var existingMessage Message
+	db.Preload("Author").Limit(1).Find(&existingMessage, "discord_id = ?", m.ID)
+	if existingMessage.ID == 0 {
+		return
+	}
+	byModerator := deletedByModerator(s, m.GuildID, m.ChannelID, existingMessage.Author.DiscordID)
+	_, err := TombstoneMessages(db, []string{m.ID}, time.Now(), byModerator)
+	if err != nil {
+		log.Default().Println("Error tombstoning message", m.ID, err)
+	}
+}
+
+func BulkDeleteHandler(s *discordgo.Session, m *discordgo.MessageDeleteBulk) {
+	log.Default().Println("Message Bulk Delete", len(m.Messages), m.ChannelID)
+	db := ConnectToDB()
+	// Users can't bulk delete, so this is always a moderator or a bot
+	_, err := TombstoneMessages(db, m.Messages, time.Now(), true)
+	if err != nil {
+		log.Default().Println("Error tombstoning messages", m.ChannelID, err)
+	}
+}
+
+func ReactionAddHandler(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	db := ConnectToDB()
+	err := AddReaction(db, r.MessageID, r.UserID, &r.Emoji)
+	if err != nil {
+		log.Default().Println("Error adding reaction", r.MessageID, err)
+	}
+}
+
+func ReactionRemoveHandler(s *discordgo.Session, r *discordgo.MessageReactionRemove) {
+	db := ConnectToDB()
+	err := RemoveReaction(db, r.MessageID, r.UserID, &r.Emoji)
+	if err != nil {
+		log.Default().Println("Error removing reaction", r.MessageID, err)
+	}
+}
+
+func ReactionRemoveAllHandler(s *discordgo.Session, r *discordgo.MessageReactionRemoveAll) {
+	db := ConnectToDB()
+	err := RemoveAllReactions(db, r.MessageID)
+	if err != nil {
+		log.Default().Println("Error removing reactions", r.MessageID, err)
+	}
+}
+
+// truncate shortens content to length characters, without splitting any
+func truncate(content string, length int) string {
+	runes := []rune(content)
+	if len(runes) <= length {
+		return content
+	}
+	return string(runes[:length]) + "..."
+}
+
+func FormatDeletedMessages(messages []*Message) string {
+	if len(messages) == 0 {
+		return "No deleted messages"
+	}
+	lines := make([]string, 0, len(messages))
+	for _, message := range messages {
+		content := truncate(message.Content, 100)
+		line := fmt.Sprintf(
+			"%s %s in <#%s>: %s",
+			message.DiscordDeletedAt.Format("2006-01-02 15:04"),
+			message.Author.Name,
+			message.Channel.DiscordID,
+			content,
+		)
+		if message.DeletedByModerator {
+			line += " (moderator)"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
 func MessageHandler(s *discordgo.Session, m *discordgo.MessageCreate) {
 	if m.Author.ID == s.State.User.ID {
 		return
 	}
+	// Webhook messages, like our own replays, have no real author to archive
+	// them under
+	if m.WebhookID != "" {
+		return
+	}
 	db := ConnectToDB()
+	if channel, err := s.State.Channel(m.ChannelID); err == nil && IsThread(channel.Type) {
+		// Catches threads from before we indexed their parent
+		IndexThreadIfParentIndexed(db, channel)
+	}
 	// NOTE: May not persist message if channel not indexed
-	_, err := PersistMessageToDb(db, m.Message)
+	persistedMessage, err := PersistMessageToDb(db, m.Message)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	if IsIndexCommand(m.Message.Content, m.Author.ID) {
-		fullCommand := strings.Split(m.Content, " ")
-		switch {
-		case len(fullCommand) == 1:
-			{
-				PersistChannelToDB(db, m.ChannelID, m.GuildID)
-				ScrapeChannelForMessages(s, m.ChannelID, DEFAULT_MESSAGES_TO_INDEX, m.ID)
-			}
-		case len(fullCommand) == 2:
-			{
-				highWaterMark := m.ID
-				messagesToIndex, err := strconv.Atoi(fullCommand[1])
-				if err != nil {
-
-					if fullCommand[1] == "more" {
-						highwaterMessage := GetHighwaterMessage(db, m.ChannelID)
-						highWaterMark = highwaterMessage.DiscordID
-						messagesToIndex = DEFAULT_MESSAGES_TO_INDEX
-					} else {
-						return
-					}
-				}
-				PersistChannelToDB(db, m.ChannelID, m.GuildID)
-				ScrapeChannelForMessages(s, m.ChannelID, messagesToIndex, highWaterMark)
-			}
+	ArchiveNewMessage(db, persistedMessage)
+	guild, err := GetGuildSettings(db, m.GuildID)
+	if err != nil {
+		log.Default().Println("Unable to load guild settings", m.GuildID, err)
+		return
+	}
+	if persistedMessage != nil {
+		err = AddToPlaybackSession(db, guild, persistedMessage)
+		if err != nil {
+			log.Default().Println("Error updating playback session", persistedMessage.ID, err)
 		}
 	}
+	if !strings.HasPrefix(m.Content, guild.Prefix()) {
+		return
+	}
+	Commands.Dispatch(&CommandContext{
+		Session:   s,
+		DB:        db,
+		Guild:     guild,
+		GuildID:   m.GuildID,
+		ChannelID: m.ChannelID,
+		AuthorID:  m.Author.ID,
+		RoleIDs:   memberRoles(m.Member),
+		MessageID: m.ID,
+	}, strings.TrimPrefix(m.Content, guild.Prefix()))
+}
+
+func memberRoles(member *discordgo.Member) []string {
+	if member == nil {
+		return nil
+	}
+	return member.Roles
+}
+
+func MemberUpdateHandler(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+	if m.Member == nil || m.User == nil {
+		return
+	}
+	err := UpdateKnownAuthorProfile(ConnectToDB(), m.User, m.Member, m.GuildID)
+	if err != nil {
+		log.Default().Println("Error updating author", m.User.ID, err)
+	}
+}
+
+func UserUpdateHandler(s *discordgo.Session, u *discordgo.UserUpdate) {
+	if u.User == nil {
+		return
+	}
+	err := UpdateKnownAuthorProfile(ConnectToDB(), u.User, nil, "")
+	if err != nil {
+		log.Default().Println("Error updating author", u.User.ID, err)
+	}
+}
+
+func ThreadCreateHandler(s *discordgo.Session, t *discordgo.ThreadCreate) {
+	IndexThreadIfParentIndexed(ConnectToDB(), t.Channel)
+}
+
+func ThreadUpdateHandler(s *discordgo.Session, t *discordgo.ThreadUpdate) {
+	db := ConnectToDB()
+	if IsChannelIndexed(db, t.ID) == 0 {
+		IndexThreadIfParentIndexed(db, t.Channel)
+		return
+	}
+	// Keep the name and archived state current
+	_, err := PersistDiscordChannelToDB(db, t.Channel)
+	if err != nil {
+		log.Default().Println("Error updating thread", t.ID, err)
+	}
 }
 
 //define discord interface so it can be mocked for testing
 type Discord interface {
-	ChannelMessageSend(channelID string, content string) (*discordgo.Message, error)
+	ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	ChannelMessageDelete(channelID string, messageID string, options ...discordgo.RequestOption) error
+	ChannelTyping(channelID string, options ...discordgo.RequestOption) error
+	ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error)
+	UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	ChannelDelete(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	GuildRoles(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Role, error)
+	ThreadStart(channelID, name string, typ discordgo.ChannelType, archiveDuration int, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	ForumThreadStart(channelID, name string, archiveDuration int, content string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	ThreadsArchived(channelID string, before *time.Time, limit int, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error)
+	GuildThreadsActive(guildID string, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error)
+	ChannelWebhooks(channelID string, options ...discordgo.RequestOption) ([]*discordgo.Webhook, error)
+	WebhookCreate(channelID, name, avatar string, options ...discordgo.RequestOption) (*discordgo.Webhook, error)
+	WebhookExecute(webhookID, token string, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	WebhookThreadExecute(webhookID, token string, wait bool, threadID string, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	WebhookMessageDelete(webhookID, token, messageID string, options ...discordgo.RequestOption) error
 }
@@ -0,0 +1,683 @@
+package ronnyd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+type ArgType int
+
+const (
+	ARG_INT ArgType = iota
+	ARG_STRING
+	ARG_USER
+	ARG_CHANNEL
+	ARG_DURATION
+)
+
+type Permission int
+
+const (
+	PERMISSION_EVERYONE Permission = iota
+	PERMISSION_ADMIN
+	// Admins and the guild's playback roles
+	PERMISSION_PLAYBACK
+)
+
+type ArgSpec struct {
+	Name        string
+	Type        ArgType
+	Description string
+	Optional    bool
+	// Limits a string arg to these values
+	Choices []string
+	// Rest takes the remainder of the input, only allowed on the last string arg
+	Rest bool
+}
+
+type Command struct {
+	Name        string
+	Aliases     []string
+	Description string
+	Args        []ArgSpec
+	Permission  Permission
+	// Private commands only answer whoever ran them, for things the rest of
+	// the channel shouldn't see
+	Private bool
+	Handler func(ctx *CommandContext) error
+}
+
+// CommandContext is everything a command handler needs to know about where
+// it was invoked and how to answer
+type CommandContext struct {
+	Session   Discord
+	DB        *gorm.DB
+	Guild     *Guild
+	Router    *CommandRouter
+	GuildID   string
+	ChannelID string
+	AuthorID  string
+	RoleIDs   []string
+	// The message that invoked the command, empty for slash commands
+	MessageID string
+	Args      map[string]interface{}
+	// Respond replaces sending replies to the channel, e.g. to answer an
+	// interaction instead
+	Respond func(content string) error
+	// Replies are sent by DM when there's no Respond, set for private commands
+	Private bool
+}
+
+// Reply answers the command. Mentions in replies are only there to say who
+// we mean, so they don't ping anyone.
+func (ctx *CommandContext) Reply(content string) error {
+	if ctx.Respond != nil {
+		return ctx.Respond(content)
+	}
+	channelID := ctx.ChannelID
+	if ctx.Private {
+		channel, err := ctx.Session.UserChannelCreate(ctx.AuthorID)
+		if err != nil {
+			return err
+		}
+		channelID = channel.ID
+	}
+	_, err := ctx.Session.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:         content,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	return err
+}
+
+func (ctx *CommandContext) IsAdmin() bool {
+	return ctx.Guild.IsAdmin(ctx.AuthorID, ctx.RoleIDs)
+}
+
+func (ctx *CommandContext) Allowed(permission Permission) bool {
+	switch permission {
+	case PERMISSION_ADMIN:
+		return ctx.IsAdmin()
+	case PERMISSION_PLAYBACK:
+		return ctx.Guild.CanPlayback(ctx.AuthorID, ctx.RoleIDs)
+	}
+	return true
+}
+
+func (ctx *CommandContext) Int(name string, fallback int) int {
+	if value, ok := ctx.Args[name].(int); ok {
+		return value
+	}
+	return fallback
+}
+
+func (ctx *CommandContext) String(name string) string {
+	value, _ := ctx.Args[name].(string)
+	return value
+}
+
+func (ctx *CommandContext) Duration(name string, fallback time.Duration) time.Duration {
+	if value, ok := ctx.Args[name].(time.Duration); ok {
+		return value
+	}
+	return fallback
+}
+
+// CommandError is a problem with how a command was used, its message is sent
+// back to the channel as is
+type CommandError struct {
+	Message string
+}
+
+func (err *CommandError) Error() string {
+	return err.Message
+}
+
+func commandErrorf(format string, a ...interface{}) error {
+	return &CommandError{Message: fmt.Sprintf(format, a...)}
+}
+
+type CommandRouter struct {
+	// Run when the prefix is used on its own or with args it doesn't name
+	DefaultCommand string
+	commands       []*Command
+	byName         map[string]*Command
+}
+
+func NewCommandRouter(defaultCommand string) *CommandRouter {
+	return &CommandRouter{
+		DefaultCommand: defaultCommand,
+		byName:         make(map[string]*Command),
+	}
+}
+
+func (router *CommandRouter) Register(command *Command) {
+	router.commands = append(router.commands, command)
+	router.byName[command.Name] = command
+	for _, alias := range command.Aliases {
+		router.byName[alias] = command
+	}
+}
+
+func (router *CommandRouter) Lookup(name string) *Command {
+	return router.byName[strings.ToLower(name)]
+}
+
+func (router *CommandRouter) Commands() []*Command {
+	return router.commands
+}
+
+var mentionPattern = regexp.MustCompile(`^<(@!?|@&|#)(\d+)>$`)
+var snowflakePattern = regexp.MustCompile(`^\d+$`)
+
+func parseMention(value string, kinds ...string) (string, bool) {
+	if snowflakePattern.MatchString(value) {
+		return value, true
+	}
+	match := mentionPattern.FindStringSubmatch(value)
+	if match == nil {
+		return "", false
+	}
+	for _, kind := range kinds {
+		if match[1] == kind {
+			return match[2], true
+		}
+	}
+	return "", false
+}
+
+func parseArg(spec ArgSpec, value string) (interface{}, error) {
+	switch spec.Type {
+	case ARG_INT:
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("%s must be a positive number", spec.Name)
+		}
+		return parsed, nil
+	case ARG_USER:
+		id, ok := parseMention(value, "@", "@!")
+		if !ok {
+			return nil, fmt.Errorf("%s must be a user mention or ID", spec.Name)
+		}
+		return id, nil
+	case ARG_CHANNEL:
+		id, ok := parseMention(value, "#")
+		if !ok {
+			return nil, fmt.Errorf("%s must be a channel mention or ID", spec.Name)
+		}
+		return id, nil
+	case ARG_DURATION:
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("%s must be a duration like 30m or 24h", spec.Name)
+		}
+		return parsed, nil
+	}
+	if len(spec.Choices) > 0 && !containsString(spec.Choices, value) {
+		return nil, fmt.Errorf("%s must be one of %s", spec.Name, strings.Join(spec.Choices, ", "))
+	}
+	return value, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseArgs matches the words after the command name against its ArgSpecs
+func (command *Command) ParseArgs(words []string) (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	for i, spec := range command.Args {
+		if i >= len(words) {
+			if !spec.Optional {
+				return nil, fmt.Errorf("missing %s", spec.Name)
+			}
+			continue
+		}
+		value := words[i]
+		if spec.Rest {
+			value = strings.Join(words[i:], " ")
+		}
+		parsed, err := parseArg(spec, value)
+		if err != nil {
+			return nil, err
+		}
+		args[spec.Name] = parsed
+	}
+	if len(words) > len(command.Args) && (len(command.Args) == 0 || !command.Args[len(command.Args)-1].Rest) {
+		return nil, errors.New("too many arguments")
+	}
+	return args, nil
+}
+
+func (command *Command) Usage(prefix string) string {
+	parts := []string{prefix, command.Name}
+	for _, spec := range command.Args {
+		if spec.Optional {
+			parts = append(parts, "["+spec.Name+"]")
+		} else {
+			parts = append(parts, "<"+spec.Name+">")
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (router *CommandRouter) resolve(words []string) (*Command, []string, error) {
+	if len(words) > 0 {
+		if command := router.Lookup(words[0]); command != nil {
+			return command, words[1:], nil
+		}
+	}
+	command := router.Lookup(router.DefaultCommand)
+	if command == nil {
+		return nil, nil, commandErrorf("Unknown command, try help")
+	}
+	if len(words) > 0 {
+		// Only fall back to the default command when it can make sense of
+		// the input, otherwise it was probably a typo
+		if _, err := command.ParseArgs(words); err != nil {
+			return nil, nil, commandErrorf("Unknown command %s, try help", words[0])
+		}
+	}
+	return command, words, nil
+}
+
+// Dispatch runs the command named in input, which is everything after the
+// prefix. Usage and permission problems are reported back to the channel.
+func (router *CommandRouter) Dispatch(ctx *CommandContext, input string) error {
+	ctx.Router = router
+	command, words, err := router.resolve(strings.Fields(input))
+	if err == nil {
+		err = router.Run(ctx, command, words)
+	}
+	return router.report(ctx, err)
+}
+
+// Run checks permissions and parses words as the command's args before
+// running it
+func (router *CommandRouter) Run(ctx *CommandContext, command *Command, words []string) error {
+	if !ctx.Allowed(command.Permission) {
+		return commandErrorf("You don't have permission to use %s", command.Name)
+	}
+	ctx.Private = command.Private
+	if ctx.Args == nil {
+		args, err := command.ParseArgs(words)
+		if err != nil {
+			return commandErrorf("%s\nUsage: %s", err, command.Usage(ctx.Guild.Prefix()))
+		}
+		ctx.Args = args
+	}
+	return command.Handler(ctx)
+}
+
+func (router *CommandRouter) report(ctx *CommandContext, err error) error {
+	if err == nil {
+		return nil
+	}
+	var commandErr *CommandError
+	if errors.As(err, &commandErr) {
+		ctx.Reply(commandErr.Message)
+		return nil
+	}
+	log.Default().Println("Error running command", ctx.ChannelID, err)
+	ctx.Reply("Something went wrong, check the logs")
+	return err
+}
+
+// Help lists the commands the invoking user is allowed to run
+func (router *CommandRouter) Help(ctx *CommandContext) string {
+	lines := make([]string, 0, len(router.commands))
+	for _, command := range router.commands {
+		if !ctx.Allowed(command.Permission) {
+			continue
+		}
+		line := "`" + command.Usage(ctx.Guild.Prefix()) + "` " + command.Description
+		if len(command.Aliases) > 0 {
+			line += " (also " + strings.Join(command.Aliases, ", ") + ")"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+var Commands = DefaultCommands()
+
+func DefaultCommands() *CommandRouter {
+	router := NewCommandRouter("index")
+	router.Register(&Command{
+		Name:        "index",
+		Aliases:     []string{"scrape"},
+		Description: "Index this channel's history, starting from here, or another channel's like a forum",
+		Args: []ArgSpec{
+			{Name: "count", Type: ARG_INT, Description: "How many messages to index", Optional: true},
+			{Name: "channel", Type: ARG_CHANNEL, Description: "Channel to index instead of this one", Optional: true},
+		},
+		Permission: PERMISSION_ADMIN,
+		Handler:    indexCommand,
+	})
+	router.Register(&Command{
+		Name:        "more",
+		Aliases:     []string{"resume"},
+		Description: "Keep indexing from where the last index stopped",
+		Args:        []ArgSpec{{Name: "count", Type: ARG_INT, Description: "How many messages to index", Optional: true}},
+		Permission:  PERMISSION_ADMIN,
+		Handler:     moreCommand,
+	})
+	router.Register(&Command{
+		Name:        "deleted",
+		Description: "List recently deleted messages",
+		Args:        []ArgSpec{{Name: "count", Type: ARG_INT, Description: "How many messages to list", Optional: true}},
+		Permission:  PERMISSION_ADMIN,
+		// Deleted messages shouldn't be undeleted in front of everyone
+		Private: true,
+		Handler: deletedCommand,
+	})
+	router.Register(&Command{
+		Name:        "settings",
+		Description: "Show this server's settings",
+		Permission:  PERMISSION_ADMIN,
+		Handler:     settingsCommand,
+	})
+	router.Register(&Command{
+		Name:        "set",
+		Description: "Change one of this server's settings",
+		Args: []ArgSpec{
+			{Name: "setting", Type: ARG_STRING, Choices: GUILD_SETTINGS},
+			{Name: "value", Type: ARG_STRING, Description: "The new value, none clears a list", Rest: true},
+		},
+		Permission: PERMISSION_ADMIN,
+		Handler:    setCommand,
+	})
+	router.Register(&Command{
+		Name:        "playback",
+		Aliases:     []string{"replay"},
+		Description: "Replay one of someone's past conversations where they happened",
+		Args: []ArgSpec{
+			{Name: "user", Type: ARG_USER, Description: "Who to replay"},
+			{Name: "grouping", Type: ARG_STRING, Description: "How to split their messages into sessions", Optional: true, Choices: SESSION_GROUPINGS},
+			{Name: "selection", Type: ARG_STRING, Description: "Which session to replay", Optional: true, Choices: SESSION_SELECTIONS},
+			{Name: "destination", Type: ARG_CHANNEL, Description: "Where to replay it, instead of where it was said", Optional: true},
+		},
+		Permission: PERMISSION_PLAYBACK,
+		Handler:    playbackCommand,
+	})
+	router.Register(&Command{
+		Name:        "memorylane",
+		Description: "Replay one of someone's past conversations in a new thread",
+		Args: []ArgSpec{
+			{Name: "user", Type: ARG_USER, Description: "Who to replay"},
+			{Name: "destination", Type: ARG_CHANNEL, Description: "Channel to start the thread in", Optional: true},
+		},
+		Permission: PERMISSION_PLAYBACK,
+		Handler:    memoryLaneCommand,
+	})
+	router.Register(&Command{
+		Name:        "sessions",
+		Description: "List someone's sessions, newest first",
+		Args: []ArgSpec{
+			{Name: "user", Type: ARG_USER, Description: "Whose sessions to list"},
+			{Name: "count", Type: ARG_INT, Description: "How many sessions to list", Optional: true},
+		},
+		Permission: PERMISSION_PLAYBACK,
+		Handler:    sessionsCommand,
+	})
+	router.Register(&Command{
+		Name:        "playsession",
+		Aliases:     []string{"replaysession"},
+		Description: "Replay one of the sessions listed by sessions",
+		Args: []ArgSpec{
+			{Name: "session", Type: ARG_INT, Description: "The session's number from sessions"},
+			{Name: "destination", Type: ARG_CHANNEL, Description: "Where to replay it, instead of where it was said", Optional: true},
+		},
+		Permission: PERMISSION_PLAYBACK,
+		Handler:    playSessionCommand,
+	})
+	router.Register(&Command{
+		Name:        "runs",
+		Description: "List recent playbacks",
+		Args:        []ArgSpec{{Name: "count", Type: ARG_INT, Description: "How many playbacks to list", Optional: true}},
+		Permission:  PERMISSION_PLAYBACK,
+		Handler:     runsCommand,
+	})
+	router.Register(&Command{
+		Name:        "undo",
+		Description: "Delete the messages sent by the latest playback, or the one given",
+		Args:        []ArgSpec{{Name: "run", Type: ARG_INT, Description: "The playback's number from runs", Optional: true}},
+		Permission:  PERMISSION_ADMIN,
+		Handler:     undoCommand,
+	})
+	router.Register(&Command{
+		Name:        "stats",
+		Description: "Show how much of this server has been archived",
+		Handler:     statsCommand,
+	})
+	router.Register(&Command{
+		Name:        "help",
+		Description: "List the commands you can use",
+		Handler: func(ctx *CommandContext) error {
+			return ctx.Reply(ctx.Router.Help(ctx))
+		},
+	})
+	return router
+}
+
+func indexCommand(ctx *CommandContext) error {
+	channelID := ctx.String("channel")
+	if channelID == "" || channelID == ctx.ChannelID {
+		persistCommandChannel(ctx.Session, ctx.DB, ctx.ChannelID, ctx.GuildID)
+		state, err := ScrapeChannelForMessages(ctx.Session, ctx.ChannelID, ctx.Int("count", ctx.Guild.IndexSize()), ctx.MessageID)
+		return reportScrape(ctx, ctx.ChannelID, state, err)
+	}
+
+	// Forums can't be typed in, so they have to be indexed from somewhere else
+	discordChannel, err := lookupChannel(ctx.Session, channelID)
+	if err != nil || discordChannel.GuildID != ctx.GuildID {
+		return commandErrorf("I can't see <#%s> in this server", channelID)
+	}
+	if _, err := PersistDiscordChannelToDB(ctx.DB, discordChannel); err != nil {
+		return err
+	}
+	if discordChannel.Type == discordgo.ChannelTypeGuildForum {
+		// A forum's messages are all in its posts
+		posts, err := ScrapeChannelThreads(ctx.Session, ctx.DB, ctx.GuildID, channelID, ctx.Int("count", ctx.Guild.IndexSize()))
+		if err != nil {
+			log.Default().Println("Error indexing forum posts", channelID, err)
+			return err
+		}
+		return ctx.Reply(fmt.Sprintf("Indexed %d posts in <#%s>", posts, channelID))
+	}
+	state, err := ScrapeChannel(ctx.Session, ctx.DB, channelID, ctx.Int("count", ctx.Guild.IndexSize()), "", SCRAPE_BACKWARD)
+	return reportScrape(ctx, channelID, state, err)
+}
+
+func moreCommand(ctx *CommandContext) error {
+	persistCommandChannel(ctx.Session, ctx.DB, ctx.ChannelID, ctx.GuildID)
+	state, err := ResumeChannelScrape(ctx.Session, ctx.DB, ctx.ChannelID, ctx.Int("count", ctx.Guild.IndexSize()))
+	return reportScrape(ctx, ctx.ChannelID, state, err)
+}
+
+func reportScrape(ctx *CommandContext, channelID string, state *ScrapeState, err error) error {
+	if err != nil {
+		log.Default().Println("Error indexing channel", channelID, err)
+	}
+	if state == nil {
+		return err
+	}
+	summary := state.Summary()
+	if err == nil {
+		threads, err := ScrapeChannelThreads(ctx.Session, ctx.DB, ctx.GuildID, channelID, ctx.Guild.IndexSize())
+		if err != nil {
+			log.Default().Println("Error indexing threads", channelID, err)
+		}
+		if threads > 0 {
+			summary += fmt.Sprintf(", plus %d threads", threads)
+		}
+	}
+	return ctx.Reply(summary)
+}
+
+func deletedCommand(ctx *CommandContext) error {
+	deletedMessages := GetRecentlyDeletedMessages(ctx.DB, ctx.GuildID, ctx.Int("count", DELETED_MESSAGES_TO_LIST))
+	return ctx.Reply(FormatDeletedMessages(deletedMessages))
+}
+
+func playbackCommand(ctx *CommandContext) error {
+	if ctx.GuildID == "" {
+		return commandErrorf("Playback only works in a server")
+	}
+	return runPlaybackCommand(ctx, &PlaybackRequest{
+		TargetID:    ctx.String("user"),
+		Guild:       ctx.Guild,
+		TriggeredBy: ctx.AuthorID,
+		Grouping:    ctx.String("grouping"),
+		Selection:   ctx.String("selection"),
+
+		DestinationChannelID: ctx.String("destination"),
+	})
+}
+
+func memoryLaneCommand(ctx *CommandContext) error {
+	if ctx.GuildID == "" {
+		return commandErrorf("Playback only works in a server")
+	}
+	return runPlaybackCommand(ctx, &PlaybackRequest{
+		TargetID:    ctx.String("user"),
+		Guild:       ctx.Guild,
+		TriggeredBy: ctx.AuthorID,
+		MemoryLane:  true,
+
+		DestinationChannelID: ctx.String("destination"),
+	})
+}
+
+func runPlaybackCommand(ctx *CommandContext, request *PlaybackRequest) error {
+	run, err := RunPlaybackRequest(ctx.Session, ctx.DB, request)
+	var blocked *PlaybackBlockedError
+	if errors.As(err, &blocked) {
+		return &CommandError{Message: blocked.Error()}
+	}
+	if run == nil {
+		return err
+	}
+	summary := PlaybackSummary(run.Replayed)
+	if err != nil {
+		log.Default().Println("Error during playback", run.ID, err)
+		summary += ", then something went wrong"
+	}
+	return ctx.Reply(summary)
+}
+
+func sessionsCommand(ctx *CommandContext) error {
+	author := GetAuthor(ctx.DB, ctx.String("user"))
+	if author == nil {
+		return commandErrorf("I don't have any messages from <@%s>", ctx.String("user"))
+	}
+	err := EnsurePlaybackSessions(ctx.DB, ctx.Guild, author.ID)
+	if err != nil {
+		return err
+	}
+	sessions := GetPlaybackSessions(ctx.DB, ctx.GuildID, author.ID, ctx.Int("count", PLAYBACK_SESSIONS_TO_LIST))
+	return ctx.Reply(FormatPlaybackSessions(sessions))
+}
+
+func playSessionCommand(ctx *CommandContext) error {
+	if ctx.GuildID == "" {
+		return commandErrorf("Playback only works in a server")
+	}
+	session := GetPlaybackSession(ctx.DB, uint(ctx.Int("session", 0)))
+	if session == nil || session.GuildID != ctx.GuildID {
+		return commandErrorf("There's no session %d in this server", ctx.Int("session", 0))
+	}
+	return runPlaybackCommand(ctx, &PlaybackRequest{
+		TargetID:    session.Author.DiscordID,
+		Guild:       ctx.Guild,
+		TriggeredBy: ctx.AuthorID,
+		SessionID:   session.ID,
+
+		DestinationChannelID: ctx.String("destination"),
+	})
+}
+
+func runsCommand(ctx *CommandContext) error {
+	return ctx.Reply(FormatPlaybackRuns(GetPlaybackRuns(ctx.DB, ctx.GuildID, ctx.Int("count", PLAYBACK_RUNS_TO_LIST))))
+}
+
+func undoCommand(ctx *CommandContext) error {
+	var run *PlaybackRun
+	if runID := ctx.Int("run", 0); runID != 0 {
+		run = GetPlaybackRun(ctx.DB, uint(runID))
+		if run == nil || run.GuildID != ctx.GuildID {
+			return commandErrorf("There's no playback #%d here", runID)
+		}
+	} else {
+		run = GetLatestPlaybackRun(ctx.DB, ctx.GuildID)
+		if run == nil {
+			return commandErrorf("Nothing to undo")
+		}
+	}
+	if !run.UndoneAt.IsZero() {
+		return commandErrorf("Playback #%d was already undone", run.ID)
+	}
+	deleted, err := UndoPlaybackRun(ctx.Session, ctx.DB, run)
+	if err != nil {
+		return err
+	}
+	return ctx.Reply(fmt.Sprintf("Deleted %d messages from playback #%d", deleted, run.ID))
+}
+
+func statsCommand(ctx *CommandContext) error {
+	stats, err := GetGuildStats(ctx.DB, ctx.GuildID)
+	if err != nil {
+		return err
+	}
+	return ctx.Reply(stats.Summary())
+}
+
+func settingsCommand(ctx *CommandContext) error {
+	return ctx.Reply(ctx.Guild.Summary())
+}
+
+func setCommand(ctx *CommandContext) error {
+	err := UpdateGuildSetting(ctx.DB, ctx.Guild, ctx.String("setting"), ctx.String("value"))
+	if err != nil {
+		return &CommandError{Message: err.Error()}
+	}
+	return ctx.Reply(ctx.Guild.Summary())
+}
+
+// persistCommandChannel stores the channel a command was run in, along with
+// its name and type when discord will tell us them
+func persistCommandChannel(s Discord, db *gorm.DB, channelID string, guildID string) {
+	discordChannel, err := lookupChannel(s, channelID)
+	if err != nil {
+		log.Default().Println("Unable to look up channel", channelID, err)
+		PersistChannelToDB(db, channelID, guildID)
+		return
+	}
+	if discordChannel.GuildID == "" {
+		discordChannel.GuildID = guildID
+	}
+	PersistDiscordChannelToDB(db, discordChannel)
+}
+
+// lookupChannel checks the state cache before asking discord
+func lookupChannel(s Discord, channelID string) (*discordgo.Channel, error) {
+	if session, ok := s.(*discordgo.Session); ok && session.State != nil {
+		channel, err := session.State.Channel(channelID)
+		if err == nil {
+			return channel, nil
+		}
+	}
+	return s.Channel(channelID)
+}
@@ -0,0 +1,141 @@
+package ronnyd
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	COOLDOWN_SCOPE_TARGET  = "target"
+	COOLDOWN_SCOPE_CHANNEL = "channel"
+	// Counts every playback in the guild, for the quotas
+	COOLDOWN_SCOPE_GUILD = "guild"
+)
+
+const QUOTA_DAY = 24 * time.Hour
+const QUOTA_WEEK = 7 * QUOTA_DAY
+
+// PlaybackCooldown tracks when playback last happened for a target, channel
+// or the whole guild, along with how many playbacks are in the current day
+// and week windows. Windows start at the first playback after the last one
+// expired.
+type PlaybackCooldown struct {
+	gorm.Model
+	GuildID        string `gorm:"uniqueIndex:idx_cooldown_subject"`
+	Scope          string `gorm:"uniqueIndex:idx_cooldown_subject"`
+	SubjectID      string `gorm:"uniqueIndex:idx_cooldown_subject"`
+	LastPlaybackAt time.Time
+	DayStart       time.Time
+	DayCount       int
+	WeekStart      time.Time
+	WeekCount      int
+}
+
+func GetPlaybackCooldown(db *gorm.DB, guildID string, scope string, subjectID string) *PlaybackCooldown {
+	var cooldown PlaybackCooldown
+	db.Limit(1).Find(&cooldown, "guild_id = ? AND scope = ? AND subject_id = ?", guildID, scope, subjectID)
+	if cooldown.ID == 0 {
+		return &PlaybackCooldown{GuildID: guildID, Scope: scope, SubjectID: subjectID}
+	}
+	return &cooldown
+}
+
+func windowCount(start time.Time, count int, window time.Duration, now time.Time) int {
+	if now.Sub(start) >= window {
+		return 0
+	}
+	return count
+}
+
+func (cooldown *PlaybackCooldown) record(now time.Time) {
+	cooldown.LastPlaybackAt = now
+	if windowCount(cooldown.DayStart, cooldown.DayCount, QUOTA_DAY, now) == 0 {
+		cooldown.DayStart = now
+		cooldown.DayCount = 0
+	}
+	cooldown.DayCount++
+	if windowCount(cooldown.WeekStart, cooldown.WeekCount, QUOTA_WEEK, now) == 0 {
+		cooldown.WeekStart = now
+		cooldown.WeekCount = 0
+	}
+	cooldown.WeekCount++
+}
+
+// CheckPlaybackQuota refuses playback once the guild has used up its daily or
+// weekly quota
+func CheckPlaybackQuota(db *gorm.DB, guild *Guild, now time.Time) error {
+	cooldown := GetPlaybackCooldown(db, guild.DiscordID, COOLDOWN_SCOPE_GUILD, guild.DiscordID)
+	if guild.DailyQuota > 0 && windowCount(cooldown.DayStart, cooldown.DayCount, QUOTA_DAY, now) >= guild.DailyQuota {
+		return &PlaybackBlockedError{
+			Reason:    fmt.Sprintf("This server has used all %d of today's playbacks", guild.DailyQuota),
+			Remaining: cooldown.DayStart.Add(QUOTA_DAY).Sub(now),
+		}
+	}
+	if guild.WeeklyQuota > 0 && windowCount(cooldown.WeekStart, cooldown.WeekCount, QUOTA_WEEK, now) >= guild.WeeklyQuota {
+		return &PlaybackBlockedError{
+			Reason:    fmt.Sprintf("This server has used all %d of this week's playbacks", guild.WeeklyQuota),
+			Remaining: cooldown.WeekStart.Add(QUOTA_WEEK).Sub(now),
+		}
+	}
+	return nil
+}
+
+// CheckTargetCooldown refuses playback of someone replayed within the guild's
+// cooldown. Replays from before cooldowns were tracked count too.
+func CheckTargetCooldown(db *gorm.DB, guild *Guild, targetID string, now time.Time) error {
+	lastPlaybackAt := GetPlaybackCooldown(db, guild.DiscordID, COOLDOWN_SCOPE_TARGET, targetID).LastPlaybackAt
+	if lastReplayedAt := LastReplayedAt(db, targetID, guild.DiscordID); lastReplayedAt.After(lastPlaybackAt) {
+		lastPlaybackAt = lastReplayedAt
+	}
+	if remaining := lastPlaybackAt.Add(guild.Cooldown()).Sub(now); remaining > 0 {
+		return &PlaybackBlockedError{
+			Reason:    "They were replayed recently",
+			Remaining: remaining,
+		}
+	}
+	return nil
+}
+
+func CheckChannelCooldown(db *gorm.DB, guild *Guild, channelID string, now time.Time) error {
+	if guild.ChannelCooldown <= 0 {
+		return nil
+	}
+	lastPlaybackAt := GetPlaybackCooldown(db, guild.DiscordID, COOLDOWN_SCOPE_CHANNEL, channelID).LastPlaybackAt
+	if remaining := lastPlaybackAt.Add(guild.ChannelCooldown).Sub(now); remaining > 0 {
+		return &PlaybackBlockedError{
+			Reason:    fmt.Sprintf("There was a playback in <#%s> recently", channelID),
+			Remaining: remaining,
+		}
+	}
+	return nil
+}
+
+// RecordPlayback starts the cooldowns and counts the playback against the
+// guild's quotas
+func RecordPlayback(db *gorm.DB, guildID string, targetID string, channelID string, now time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		subjects := map[string]string{
+			COOLDOWN_SCOPE_TARGET:  targetID,
+			COOLDOWN_SCOPE_CHANNEL: channelID,
+			COOLDOWN_SCOPE_GUILD:   guildID,
+		}
+		for scope, subjectID := range subjects {
+			cooldown := PlaybackCooldown{GuildID: guildID, Scope: scope, SubjectID: subjectID}
+			result := tx.Clauses(
+				clause.Locking{Strength: "UPDATE"},
+			).Where(cooldown).FirstOrCreate(&cooldown)
+			if result.Error != nil {
+				return result.Error
+			}
+			cooldown.record(now)
+			result = tx.Save(&cooldown)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		return nil
+	})
+}
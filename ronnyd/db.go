@@ -18,16 +18,33 @@ type Author struct {
 	DiscordID     string `gorm:"uniqueIndex"`
 	Name          string
 	Discriminator string
+	Avatar        string
+	// The display name the author picked for everywhere, empty if they
+	// haven't
+	GlobalName string
+	// The most recent nickname we've seen in any guild, see AuthorHistory
+	// for the nickname in a particular guild
+	Nickname string
 }
 
 type Channel struct {
 	gorm.Model
 	DiscordID string `gorm:"uniqueIndex"`
 	GuildId   string
+	Name      string
+	// A discordgo.ChannelType
+	Type int
+	// Set for threads, which are indexed along with the channel they were
+	// started in
+	ParentID *uint    `gorm:"index"`
+	Parent   *Channel `gorm:"constraint:OnDelete:SET NULL"`
+	Archived bool
+	Locked   bool
 }
 
 type Message struct {
 	gorm.Model
+	// Always the latest revision of the content, see Revisions for the rest
 	Content          string
 	MessageTimestamp time.Time `gorm:"index"`
 	DiscordID        string    `gorm:"index"`
@@ -36,7 +53,26 @@ type Message struct {
 	AuthorID         uint
 	Author           Author
 	ReplayedAt       time.Time
-	EditedAt 	     time.Time  `gorm:"index"`
+	EditedAt         time.Time `gorm:"index"`
+	// Set when the message is deleted on discord, we keep the row around but
+	// it should never be replayed
+	DiscordDeletedAt   time.Time `gorm:"index"`
+	DeletedByModerator bool
+	CurrentRevisionID  *uint
+	// The message this one is replying to, ReferencedMessageID is only set
+	// once we have stored the referenced message
+	ReferencedDiscordID string            `gorm:"index"`
+	ReferencedMessageID *uint             `gorm:"index"`
+	ReferencedMessage   *Message          `gorm:"constraint:OnDelete:SET NULL"`
+	Revisions           []MessageRevision `gorm:"constraint:OnDelete:CASCADE"`
+	Attachments         []Attachment      `gorm:"constraint:OnDelete:CASCADE"`
+	Embeds              []Embed           `gorm:"constraint:OnDelete:CASCADE"`
+	Stickers            []Sticker         `gorm:"constraint:OnDelete:CASCADE"`
+	Reactions           []Reaction        `gorm:"constraint:OnDelete:CASCADE"`
+	// Total of all the reaction counts, kept up to date alongside Reactions
+	ReactionCount int
+	// The stored session this message was grouped into, see PlaybackSession
+	PlaybackSessionID *uint `gorm:"index"`
 }
 
 func ConnectToDB() *gorm.DB {
@@ -56,22 +92,7 @@ func ConnectToDB() *gorm.DB {
 }
 
 func PersistAuthorToDB(db *gorm.DB, author *discordgo.User) (*Author, error) {
-	var existingAuthor Author
-	db.Limit(1).Find(&existingAuthor, "discord_id = ?", author.ID)
-	if existingAuthor.ID != 0 {
-		return &existingAuthor, nil
-	}
-
-	newAuthor := &Author{
-		Name:          author.Username,
-		Discriminator: author.Discriminator,
-		DiscordID:     author.ID,
-	}
-	result := db.Create(newAuthor)
-	if result.Error != nil {
-		return nil, result.Error
-	}
-	return newAuthor, nil
+	return PersistAuthorProfile(db, author, nil, "")
 }
 
 func PersistChannelToDB(db *gorm.DB, channelId string, guildId string) (*Channel, error) {
@@ -105,21 +126,38 @@ func IsChannelIndexed(db *gorm.DB, channelId string) uint {
 }
 
 func PersistMessageToDb(db *gorm.DB, msg *discordgo.Message) (*Message, error) {
+	message, _, err := PersistNewMessageToDb(db, msg)
+	return message, err
+}
+
+// PersistNewMessageToDb is PersistMessageToDb, also saying whether the message
+// was new rather than already stored
+func PersistNewMessageToDb(db *gorm.DB, msg *discordgo.Message) (*Message, bool, error) {
 	log.Default().Println("Received message: ", msg.Content, " from ", msg.Author.Username, " in ", msg.ChannelID)
 	channelID := IsChannelIndexed(db, msg.ChannelID)
 	if channelID == 0 {
-		return nil, nil
+		return nil, false, nil
 	}
-	author, err := PersistAuthorToDB(db, msg.Author)
+	author, err := PersistAuthorProfile(db, msg.Author, msg.Member, msg.GuildID)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	var existingMessage Message
 	db.Limit(1).Find(&existingMessage, "discord_id = ?", msg.ID)
 	if existingMessage.ID != 0 {
 		log.Default().Println("Ignoring existing message for persist", existingMessage.ID, msg.ID)
-		return &existingMessage, nil
+		if msg.Reactions != nil {
+			// Rescraping is how we find out about reactions from while we
+			// weren't listening
+			err = db.Transaction(func(tx *gorm.DB) error {
+				return syncReactionCounts(tx, &existingMessage, msg.Reactions)
+			})
+			if err != nil {
+				return nil, false, err
+			}
+		}
+		return &existingMessage, false, nil
 	}
 	newMessage := &Message{
 		Content:          msg.Content,
@@ -128,74 +166,149 @@ func PersistMessageToDb(db *gorm.DB, msg *discordgo.Message) (*Message, error) {
 		ChannelID:        channelID,
 		AuthorID:         author.ID,
 	}
-	result := db.Create(newMessage)
-	if result.Error != nil {
-		return nil, result.Error
+	resolveMessageReference(db, newMessage, msg)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Create(newMessage)
+		if result.Error != nil {
+			return result.Error
+		}
+		err := linkReplies(tx, newMessage)
+		if err != nil {
+			return err
+		}
+		revision, err := createRevision(tx, newMessage, msg.Content, msg.Timestamp)
+		if err != nil {
+			return err
+		}
+		newMessage.CurrentRevisionID = &revision.ID
+		err = persistMessageAssets(tx, newMessage, msg)
+		if err != nil {
+			return err
+		}
+		if msg.Reactions != nil {
+			return syncReactionCounts(tx, newMessage, msg.Reactions)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
 	}
 	log.Default().Println("Created new message", newMessage.ID, msg.ID)
-	return newMessage, nil
+	return newMessage, true, nil
 }
 
+// UpdateMessage records an edit as a new revision of the stored message
 func UpdateMessage(db *gorm.DB, msg *discordgo.Message) error {
-	tx := db.Begin()
-
-	var existingMessage Message
-	err := db.Clauses(
-		clause.Locking{Strength: "UPDATE"},
-	).Last(
-		&existingMessage, 
-		"discord_id = ?", 
-		msg.ID,
-	)
-	if err.Error != nil {
-		log.Default().Println("Error updating message", err.Error)
-		tx.Rollback()
-		return err.Error
-	}
-	var editedTimestamp time.Time
-	if msg.EditedTimestamp != nil {
-		editedTimestamp = *msg.EditedTimestamp
-	} else {
+	if msg.EditedTimestamp == nil {
 		return errors.New("no edited timestamp")
 	}
+	editedTimestamp := *msg.EditedTimestamp
 
-	newMessage := &Message{
-		Content:          msg.Content,
-		MessageTimestamp: editedTimestamp,
-		DiscordID:        msg.ID,
-		ChannelID:        existingMessage.ChannelID,
-		AuthorID:         existingMessage.AuthorID,
-	}
-	result := tx.Save(newMessage)
-	if result.Error != nil {
-		log.Default().Println("Error updating message", result.Error)
-		tx.Rollback()
-		return result.Error
+	return db.Transaction(func(tx *gorm.DB) error {
+		var existingMessage Message
+		result := tx.Clauses(
+			clause.Locking{Strength: "UPDATE"},
+		).First(
+			&existingMessage,
+			"discord_id = ?",
+			msg.ID,
+		)
+		if result.Error != nil {
+			log.Default().Println("Error updating message", result.Error)
+			return result.Error
+		}
+		if existingMessage.Content == msg.Content && existingMessage.EditedAt.Equal(editedTimestamp) {
+			// Discord resends updates, e.g. when embeds resolve
+			return nil
+		}
+
+		previousContent := existingMessage.Content
+		if existingMessage.CurrentRevisionID == nil {
+			// Stored before we kept revisions, so hang on to the original first
+			_, err := createRevision(tx, &existingMessage, existingMessage.Content, existingMessage.MessageTimestamp)
+			if err != nil {
+				log.Default().Println("Error updating message", err)
+				return err
+			}
+		}
+		_, err := createRevision(tx, &existingMessage, msg.Content, editedTimestamp)
+		if err != nil {
+			log.Default().Println("Error updating message", err)
+			return err
+		}
+		result = tx.Model(&existingMessage).Updates(map[string]interface{}{
+			"content":   msg.Content,
+			"edited_at": editedTimestamp,
+		})
+		if result.Error != nil {
+			log.Default().Println("Error updating message", result.Error)
+			return result.Error
+		}
+		err = persistMessageAssets(tx, &existingMessage, msg)
+		if err != nil {
+			return err
+		}
+		existingMessage.Content = msg.Content
+		return UpdatePlaybackSessionsForEdit(tx, &existingMessage, previousContent)
+	})
+}
+
+func GetMessagesForPlayback(db *gorm.DB, authorID string) map[time.Time][]*Message {
+	return GetGuildMessagesForPlayback(db, authorID, DefaultGuildSettings())
+}
+
+// GetGuildMessagesForPlayback groups messages using the guild's settings,
+// only looking at the guild's channels unless it's the default settings
+func GetGuildMessagesForPlayback(db *gorm.DB, authorID string, guild *Guild) map[time.Time][]*Message {
+	return GroupMessagesForPlayback(db, authorID, guild, guild.Grouper())
+}
+
+// preloadForPlayback loads everything we need to send a message again
+func preloadForPlayback(db *gorm.DB) *gorm.DB {
+	return db.Preload("Author").Preload("Channel").Preload(
+		"Attachments",
+	).Preload("Embeds").Preload("Stickers").Preload("ReferencedMessage.Author")
+}
+
+// loadForPlayback reloads a session picked from GroupMessagesForPlayback with
+// everything we need to send it again
+func loadForPlayback(db *gorm.DB, session []*Message) []*Message {
+	if len(session) == 0 {
+		return nil
 	}
-	existingMessage.EditedAt = *msg.EditedTimestamp
-	result = tx.Save(&existingMessage)
-	if result.Error != nil {
-		log.Default().Println("Error updating message", result.Error)
-		tx.Rollback()
-		return result.Error
+	ids := make([]uint, 0, len(session))
+	for _, message := range session {
+		ids = append(ids, message.ID)
 	}
-	tx.Commit()
-	return nil
+	var messages []*Message
+	preloadForPlayback(db).Where("id IN ?", ids).Order("message_timestamp").Find(&messages)
+	return messages
 }
 
-func GetMessagesForPlayback(db *gorm.DB, authorID string) map[time.Time][]*Message {
-	// XXX: This algorithm looks at all messages from user, and basically does a
-	// query for each one in order to group them. This is pretty inefficient,
-	// probably we should be looking at the 100 most recent unreplayed messages
+// GroupMessagesForPlayback returns the author's sessions keyed by when they
+// started. Only the messages themselves are loaded, see loadForPlayback for
+// the rest of whichever session gets picked.
+func GroupMessagesForPlayback(db *gorm.DB, authorID string, guild *Guild, grouper SessionGrouper) map[time.Time][]*Message {
 	var messages []*Message
-	db.Preload("Author").Preload("Channel").Joins(
+	query := db.Joins(
 		"JOIN authors ON authors.id = messages.author_id",
 	).Joins(
 		"JOIN channels ON channels.id = messages.channel_id",
-	).Where(
+	)
+	if guild.DiscordID != "" {
+		query = query.Where("channels.guild_id = ?", guild.DiscordID)
+	}
+	if sources := guild.PlaybackSourceChannelIDs(); sources != nil {
+		// Threads are replayed alongside the channel they're in
+		query = query.Where(
+			"channels.discord_id IN @sources OR channels.parent_id IN (SELECT id FROM channels WHERE discord_id IN @sources)",
+			map[string]interface{}{"sources": sources},
+		)
+	}
+	query.Where(
 		"messages.replayed_at = ?", time.Time{},
 	).Where(
-		"messages.edited_at <= ?", time.Time{},
+		"messages.discord_deleted_at = ?", time.Time{},
 	).Where(
 		"authors.discord_id = ?",
 		authorID,
@@ -206,23 +319,16 @@ func GetMessagesForPlayback(db *gorm.DB, authorID string) map[time.Time][]*Messa
 		return nil
 	}
 
-	var messageSessions map[time.Time][]*Message
-	var startingTime time.Time
-	messageSessions = make(map[time.Time][]*Message)
+	candidates := make([]*Message, 0, len(messages))
 	for _, message := range messages {
-		if IsIndexCommand(message.Content, message.Author.DiscordID) {
+		if IsIndexCommand(message.Content, authorID) || guild.IsCommand(message.Content) {
 			continue
 		}
-		// decide if we should group into a new session
-		if message.MessageTimestamp.Sub(startingTime) > 5*time.Minute {
-			startingTime = message.MessageTimestamp
-			messageSessions[startingTime] = make([]*Message, 0)
-		} else if thereExistsMessageFromSomeoneElseInBetween(db, startingTime, message.MessageTimestamp, message.AuthorID, message.ChannelID) {
-			startingTime = message.MessageTimestamp
-			messageSessions[startingTime] = make([]*Message, 0)
-		}
-
-		messageSessions[startingTime] = append(messageSessions[startingTime], message)
+		candidates = append(candidates, message)
+	}
+	messageSessions := make(map[time.Time][]*Message)
+	for _, session := range grouper.Group(db, candidates) {
+		messageSessions[session[0].MessageTimestamp] = session
 	}
 	return messageSessions
 }
@@ -242,6 +348,30 @@ func thereExistsMessageFromSomeoneElseInBetween(db *gorm.DB, startingTime time.T
 	return inBetweenMessage.ID != 0
 }
 
+// TombstoneMessages marks stored messages as deleted on discord, returning how
+// many rows were affected. Messages we never stored are ignored.
+func TombstoneMessages(db *gorm.DB, discordIDs []string, deletedAt time.Time, byModerator bool) (int64, error) {
+	result := db.Model(&Message{}).Where(
+		"discord_id IN ? AND discord_deleted_at = ?", discordIDs, time.Time{},
+	).Updates(map[string]interface{}{
+		"discord_deleted_at":   deletedAt,
+		"deleted_by_moderator": byModerator,
+	})
+	return result.RowsAffected, result.Error
+}
+
+func GetRecentlyDeletedMessages(db *gorm.DB, guildID string, limit int) []*Message {
+	var messages []*Message
+	db.Preload("Author").Preload("Channel").Joins(
+		"JOIN channels ON channels.id = messages.channel_id",
+	).Where(
+		"messages.discord_deleted_at > ?", time.Time{},
+	).Where(
+		"channels.guild_id = ?", guildID,
+	).Order("messages.discord_deleted_at desc").Limit(limit).Find(&messages)
+	return messages
+}
+
 func MarkMessageAsReplayed(db *gorm.DB, message *Message) error {
 	result := db.Model(&message).Update("replayed_at", time.Now())
 	if result.Error != nil {
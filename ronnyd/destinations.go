@@ -0,0 +1,196 @@
+package ronnyd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+// parseDestinations reads source=destination pairs of channel mentions or
+// IDs. "none" clears the mapping.
+func parseDestinations(value string) (map[string]string, error) {
+	destinations := make(map[string]string)
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if field == "none" {
+			return make(map[string]string), nil
+		}
+		source, destination, ok := strings.Cut(field, "=")
+		sourceID, sourceOk := parseMention(source, "#")
+		destinationID, destinationOk := parseMention(destination, "#")
+		if !ok || !sourceOk || !destinationOk {
+			return nil, fmt.Errorf("playback_destinations should look like #source=#destination, not %q", field)
+		}
+		destinations[sourceID] = destinationID
+	}
+	return destinations, nil
+}
+
+func formatDestinations(destinations map[string]string) string {
+	if len(destinations) == 0 {
+		return "same channel"
+	}
+	pairs := make([]string, 0, len(destinations))
+	for source, destination := range destinations {
+		pairs = append(pairs, "<#"+source+">=<#"+destination+">")
+	}
+	// Map order is random, keep the summary stable
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// everyoneCanView is whether the @everyone role can see the channel, going by
+// the role's permissions in the guild and the channel's overwrite for it
+func everyoneCanView(s Discord, channel *discordgo.Channel) (bool, error) {
+	roles, err := s.GuildRoles(channel.GuildID)
+	if err != nil {
+		return false, err
+	}
+	var permissions int64
+	for _, role := range roles {
+		// The @everyone role shares the guild's ID
+		if role.ID == channel.GuildID {
+			permissions = role.Permissions
+		}
+	}
+	if permissions&discordgo.PermissionAdministrator != 0 {
+		return true, nil
+	}
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.Type == discordgo.PermissionOverwriteTypeRole && overwrite.ID == channel.GuildID {
+			permissions = permissions&^overwrite.Deny | overwrite.Allow
+		}
+	}
+	return permissions&discordgo.PermissionViewChannel != 0, nil
+}
+
+// IsChannelPrivate is true when @everyone can't see the channel. Public
+// threads are as private as the channel they're in.
+func IsChannelPrivate(s Discord, channel *discordgo.Channel) bool {
+	if channel.Type == discordgo.ChannelTypeGuildPrivateThread {
+		return true
+	}
+	if IsThread(channel.Type) && channel.ParentID != "" {
+		parent, err := s.Channel(channel.ParentID)
+		if err != nil {
+			// Err on the side of not leaking anything
+			return true
+		}
+		channel = parent
+	}
+	visible, err := everyoneCanView(s, channel)
+	if err != nil {
+		fmt.Println("Unable to check who can see channel", channel.ID, err)
+		return true
+	}
+	return !visible
+}
+
+// sameAudience is whether everyone who can see destination can see source,
+// without having to work out who can see either: public threads are seen by
+// whoever sees the channel they're in
+func sameAudience(source *discordgo.Channel, destination *discordgo.Channel) bool {
+	return source.ID == destination.ID ||
+		(IsThread(source.Type) && source.Type != discordgo.ChannelTypeGuildPrivateThread && source.ParentID == destination.ID)
+}
+
+// CheckPlaybackDestination refuses to replay messages outside the guild's
+// allowed playback channels, or from a private channel anywhere but where
+// they were said, since we can't tell who else would see them
+func CheckPlaybackDestination(s Discord, guild *Guild, sourceID string, destinationID string) error {
+	if !guild.CanPlaybackIn(destinationID) {
+		return &PlaybackBlockedError{Reason: fmt.Sprintf("Playback isn't allowed in <#%s>", destinationID)}
+	}
+	if sourceID == destinationID {
+		return nil
+	}
+	source, err := s.Channel(sourceID)
+	if err != nil {
+		return err
+	}
+	destination, err := s.Channel(destinationID)
+	if err != nil {
+		return err
+	}
+	if destination.GuildID != source.GuildID {
+		return &PlaybackBlockedError{Reason: "Playback can't leave the server it came from"}
+	}
+	if !sameAudience(source, destination) && IsChannelPrivate(s, source) {
+		return &PlaybackBlockedError{Reason: fmt.Sprintf("Messages from <#%s> can only be replayed there", sourceID)}
+	}
+	return nil
+}
+
+// startMemoryLane makes a new thread in channelID to replay a session into
+func startMemoryLane(s Discord, channelID string, target *Author, sessionStart time.Time) (string, error) {
+	thread, err := s.ThreadStart(
+		channelID,
+		fmt.Sprintf("Memory lane: %s, %s", target.Name, sessionStart.Format("2 Jan 2006")),
+		discordgo.ChannelTypeGuildPublicThread,
+		REPLAY_THREAD_ARCHIVE_DURATION,
+	)
+	if err != nil {
+		return "", err
+	}
+	return thread.ID, nil
+}
+
+// homeChannelID is where messages from channel are replayed by default:
+// threads are replayed alongside the channel they're in
+func homeChannelID(db *gorm.DB, channel *Channel) string {
+	if channel.ParentID == nil {
+		return channel.DiscordID
+	}
+	var parent Channel
+	db.First(&parent, *channel.ParentID)
+	return parent.DiscordID
+}
+
+// resolveDestination works out where the run replays its messages, when that
+// isn't each message's own channel, and checks every channel in the session
+// can be replayed there. The request's destination wins over the guild's
+// mapping for the session's channel.
+func resolveDestination(s Discord, db *gorm.DB, request *PlaybackRequest, run *PlaybackRun, messages []*Message) error {
+	source := &messages[0].Channel
+	destination := request.DestinationChannelID
+	if destination == "" {
+		destination = request.Guild.PlaybackDestinations[source.DiscordID]
+	}
+	if destination == "" && !request.MemoryLane {
+		// Each message goes back where it was said, and a session can span
+		// channels, e.g. a stored one replayed by ID
+		checked := make(map[string]bool)
+		for _, message := range messages {
+			home := homeChannelID(db, &message.Channel)
+			if checked[home] {
+				continue
+			}
+			checked[home] = true
+			err := CheckPlaybackDestination(s, request.Guild, home, home)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if destination == "" {
+		destination = homeChannelID(db, source)
+	}
+	checked := make(map[string]bool)
+	for _, message := range messages {
+		if checked[message.Channel.DiscordID] {
+			continue
+		}
+		checked[message.Channel.DiscordID] = true
+		err := CheckPlaybackDestination(s, request.Guild, message.Channel.DiscordID, destination)
+		if err != nil {
+			return err
+		}
+	}
+	run.ReplayIntoChannelID = destination
+	run.DestinationChannelID = destination
+	return nil
+}
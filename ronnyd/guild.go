@@ -0,0 +1,367 @@
+package ronnyd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const DEFAULT_SESSION_GAP = 5 * time.Minute
+const DEFAULT_PLAYBACK_COOLDOWN = 24 * time.Hour
+
+// Guild holds per guild settings. Zero values fall back to the defaults, so
+// the accessors should be used rather than the fields.
+type Guild struct {
+	gorm.Model
+	DiscordID        string `gorm:"uniqueIndex"`
+	CommandPrefix    string
+	AdminRoleIDs     []string `gorm:"serializer:json"`
+	DefaultIndexSize int
+	PlaybackCooldown time.Duration
+	// How long before playback can post in the same channel again
+	ChannelCooldown time.Duration
+	// Playbacks allowed per day and per week, unlimited when 0
+	DailyQuota  int
+	WeeklyQuota int
+	SessionGap  time.Duration
+	// Name of the SessionGrouper to use, and the longest session the
+	// max_length grouping allows
+	SessionGrouping  string
+	MaxSessionLength time.Duration
+	// Channels playback is allowed to post in, any channel when empty
+	AllowedPlaybackChannelIDs []string `gorm:"serializer:json"`
+	// Roles that can trigger playback without being admins
+	PlaybackRoleIDs []string `gorm:"serializer:json"`
+	// One of PLAYBACK_DELIVERIES
+	PlaybackDelivery string
+	// Where to replay sessions from a channel, keyed by source channel ID.
+	// Unmapped channels are replayed into themselves.
+	PlaybackDestinations map[string]string `gorm:"serializer:json"`
+}
+
+// DefaultGuildSettings are used where there is no guild, e.g. DMs and the CLI
+func DefaultGuildSettings() *Guild {
+	return &Guild{}
+}
+
+func GetGuildSettings(db *gorm.DB, guildID string) (*Guild, error) {
+	if guildID == "" {
+		return DefaultGuildSettings(), nil
+	}
+	var guild Guild
+	result := db.Where(Guild{DiscordID: guildID}).FirstOrCreate(&guild)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &guild, nil
+}
+
+func (guild *Guild) Prefix() string {
+	if guild.CommandPrefix == "" {
+		return INDEX_COMMAND
+	}
+	return guild.CommandPrefix
+}
+
+func (guild *Guild) IndexSize() int {
+	if guild.DefaultIndexSize <= 0 {
+		return DEFAULT_MESSAGES_TO_INDEX
+	}
+	return guild.DefaultIndexSize
+}
+
+func (guild *Guild) Cooldown() time.Duration {
+	if guild.PlaybackCooldown <= 0 {
+		return DEFAULT_PLAYBACK_COOLDOWN
+	}
+	return guild.PlaybackCooldown
+}
+
+func (guild *Guild) Gap() time.Duration {
+	if guild.SessionGap <= 0 {
+		return DEFAULT_SESSION_GAP
+	}
+	return guild.SessionGap
+}
+
+func (guild *Guild) MaxLength() time.Duration {
+	if guild.MaxSessionLength <= 0 {
+		return DEFAULT_MAX_SESSION_LENGTH
+	}
+	return guild.MaxSessionLength
+}
+
+func (guild *Guild) Delivery() string {
+	if guild.PlaybackDelivery == "" {
+		return PLAYBACK_DELIVERY_BOT
+	}
+	return guild.PlaybackDelivery
+}
+
+// Grouper is the guild's session grouping, falling back to the default if
+// it's been set to something we no longer have
+func (guild *Guild) Grouper() SessionGrouper {
+	grouper, err := NewSessionGrouper(guild.SessionGrouping, guild)
+	if err != nil {
+		grouper, _ = NewSessionGrouper(SESSION_GROUPING_DEFAULT, guild)
+	}
+	return grouper
+}
+
+// IsCommand is only true for a custom prefix, messages starting with the
+// default one are left to IsIndexCommand
+func (guild *Guild) IsCommand(content string) bool {
+	return guild.CommandPrefix != "" && strings.HasPrefix(content, guild.CommandPrefix)
+}
+
+// IsAdmin checks whether someone can run admin commands. The ADMIN_DISCORD_ID
+// user is an admin everywhere.
+func (guild *Guild) IsAdmin(authorID string, roleIDs []string) bool {
+	LoadConfig()
+	if authorID == os.Getenv("ADMIN_DISCORD_ID") {
+		return true
+	}
+	for _, roleID := range roleIDs {
+		for _, adminRoleID := range guild.AdminRoleIDs {
+			if roleID == adminRoleID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CanPlaybackIn is whether playback is allowed to post in the channel
+func (guild *Guild) CanPlaybackIn(channelID string) bool {
+	return len(guild.AllowedPlaybackChannelIDs) == 0 || containsString(guild.AllowedPlaybackChannelIDs, channelID)
+}
+
+// PlaybackSourceChannelIDs is the channels whose messages would be replayed
+// somewhere playback is allowed, nil when it's allowed everywhere
+func (guild *Guild) PlaybackSourceChannelIDs() []string {
+	if len(guild.AllowedPlaybackChannelIDs) == 0 {
+		return nil
+	}
+	sources := make([]string, 0, len(guild.AllowedPlaybackChannelIDs))
+	for _, channelID := range guild.AllowedPlaybackChannelIDs {
+		if _, mapped := guild.PlaybackDestinations[channelID]; !mapped {
+			sources = append(sources, channelID)
+		}
+	}
+	for source, destination := range guild.PlaybackDestinations {
+		if guild.CanPlaybackIn(destination) {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+func (guild *Guild) CanPlayback(authorID string, roleIDs []string) bool {
+	if guild.IsAdmin(authorID, roleIDs) {
+		return true
+	}
+	for _, roleID := range roleIDs {
+		if containsString(guild.PlaybackRoleIDs, roleID) {
+			return true
+		}
+	}
+	return false
+}
+
+// GUILD_SETTINGS lists the settings that can be changed with the set command
+var GUILD_SETTINGS = []string{
+	"prefix",
+	"admin_roles",
+	"index_size",
+	"playback_cooldown",
+	"channel_cooldown",
+	"daily_quota",
+	"weekly_quota",
+	"session_gap",
+	"session_grouping",
+	"max_session_length",
+	"playback_channels",
+	"playback_roles",
+	"playback_delivery",
+	"playback_destinations",
+}
+
+// parseIDList accepts role and channel mentions as well as bare IDs. "none"
+// clears the list.
+func parseIDList(value string) []string {
+	ids := make([]string, 0)
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if field == "none" {
+			return make([]string, 0)
+		}
+		field = strings.TrimPrefix(strings.TrimSuffix(field, ">"), "<")
+		field = strings.TrimLeft(field, "@&#")
+		if field != "" {
+			ids = append(ids, field)
+		}
+	}
+	return ids
+}
+
+func UpdateGuildSetting(db *gorm.DB, guild *Guild, key string, value string) error {
+	if guild.ID == 0 {
+		return errors.New("settings can only be changed in a guild")
+	}
+	switch key {
+	case "prefix":
+		if value == "" || strings.ContainsAny(value, " \n") {
+			return errors.New("prefix can't be empty or contain spaces")
+		}
+		guild.CommandPrefix = value
+	case "admin_roles":
+		guild.AdminRoleIDs = parseIDList(value)
+	case "index_size":
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			return fmt.Errorf("index_size must be a positive number, not %q", value)
+		}
+		guild.DefaultIndexSize = size
+	case "daily_quota", "weekly_quota":
+		quota, err := strconv.Atoi(value)
+		if err != nil || quota < 0 {
+			return fmt.Errorf("%s must be a number, 0 for unlimited, not %q", key, value)
+		}
+		if key == "daily_quota" {
+			guild.DailyQuota = quota
+		} else {
+			guild.WeeklyQuota = quota
+		}
+	case "session_grouping":
+		if !containsString(SESSION_GROUPINGS, value) {
+			return fmt.Errorf("session_grouping must be one of %s, not %q", strings.Join(SESSION_GROUPINGS, ", "), value)
+		}
+		guild.SessionGrouping = value
+	case "playback_cooldown", "channel_cooldown", "session_gap", "max_session_length":
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return fmt.Errorf("%s must be a duration like 30m or 24h, not %q", key, value)
+		}
+		switch key {
+		case "playback_cooldown":
+			guild.PlaybackCooldown = duration
+		case "channel_cooldown":
+			guild.ChannelCooldown = duration
+		case "max_session_length":
+			guild.MaxSessionLength = duration
+		default:
+			guild.SessionGap = duration
+		}
+	case "playback_channels":
+		guild.AllowedPlaybackChannelIDs = parseIDList(value)
+	case "playback_roles":
+		guild.PlaybackRoleIDs = parseIDList(value)
+	case "playback_delivery":
+		if !containsString(PLAYBACK_DELIVERIES, value) {
+			return fmt.Errorf("playback_delivery must be one of %s, not %q", strings.Join(PLAYBACK_DELIVERIES, ", "), value)
+		}
+		guild.PlaybackDelivery = value
+	case "playback_destinations":
+		destinations, err := parseDestinations(value)
+		if err != nil {
+			return err
+		}
+		guild.PlaybackDestinations = destinations
+	default:
+		return fmt.Errorf("unknown setting %q, try one of %s", key, strings.Join(GUILD_SETTINGS, ", "))
+	}
+	return db.Save(guild).Error
+}
+
+func formatIDList(ids []string, mentionPrefix string) string {
+	if len(ids) == 0 {
+		return "any"
+	}
+	mentions := make([]string, 0, len(ids))
+	for _, id := range ids {
+		mentions = append(mentions, "<"+mentionPrefix+id+">")
+	}
+	return strings.Join(mentions, " ")
+}
+
+func formatQuota(quota int) string {
+	if quota == 0 {
+		return "unlimited"
+	}
+	return strconv.Itoa(quota)
+}
+
+func (guild *Guild) Summary() string {
+	adminRoles := "none"
+	if len(guild.AdminRoleIDs) > 0 {
+		adminRoles = formatIDList(guild.AdminRoleIDs, "@&")
+	}
+	sessionGrouping := guild.SessionGrouping
+	if sessionGrouping == "" {
+		sessionGrouping = SESSION_GROUPING_DEFAULT
+	}
+	playbackRoles := "admins only"
+	if len(guild.PlaybackRoleIDs) > 0 {
+		playbackRoles = formatIDList(guild.PlaybackRoleIDs, "@&")
+	}
+	return strings.Join([]string{
+		"prefix: " + guild.Prefix(),
+		"admin_roles: " + adminRoles,
+		"index_size: " + strconv.Itoa(guild.IndexSize()),
+		"playback_cooldown: " + guild.Cooldown().String(),
+		"channel_cooldown: " + guild.ChannelCooldown.String(),
+		"daily_quota: " + formatQuota(guild.DailyQuota),
+		"weekly_quota: " + formatQuota(guild.WeeklyQuota),
+		"session_gap: " + guild.Gap().String(),
+		"session_grouping: " + sessionGrouping,
+		"max_session_length: " + guild.MaxLength().String(),
+		"playback_channels: " + formatIDList(guild.AllowedPlaybackChannelIDs, "#"),
+		"playback_roles: " + playbackRoles,
+		"playback_delivery: " + guild.Delivery(),
+		"playback_destinations: " + formatDestinations(guild.PlaybackDestinations),
+	}, "\n")
+}
+
+type GuildStats struct {
+	Channels int64
+	Authors  int64
+	Messages int64
+	Replayed int64
+}
+
+func GetGuildStats(db *gorm.DB, guildID string) (*GuildStats, error) {
+	stats := &GuildStats{}
+	result := db.Model(&Channel{}).Where("guild_id = ?", guildID).Count(&stats.Channels)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	guildMessages := func() *gorm.DB {
+		return db.Model(&Message{}).Joins(
+			"JOIN channels ON channels.id = messages.channel_id",
+		).Where("channels.guild_id = ?", guildID)
+	}
+	result = guildMessages().Count(&stats.Messages)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	result = guildMessages().Distinct("messages.author_id").Count(&stats.Authors)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	result = guildMessages().Where("messages.replayed_at > ?", time.Time{}).Count(&stats.Replayed)
+	return stats, result.Error
+}
+
+func (stats *GuildStats) Summary() string {
+	return fmt.Sprintf(
+		"%d messages from %d authors in %d channels, %d replayed",
+		stats.Messages,
+		stats.Authors,
+		stats.Channels,
+		stats.Replayed,
+	)
+}
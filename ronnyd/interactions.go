@@ -0,0 +1,168 @@
+package ronnyd
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+var argOptionTypes = map[ArgType]discordgo.ApplicationCommandOptionType{
+	ARG_INT:      discordgo.ApplicationCommandOptionInteger,
+	ARG_STRING:   discordgo.ApplicationCommandOptionString,
+	ARG_USER:     discordgo.ApplicationCommandOptionUser,
+	ARG_CHANNEL:  discordgo.ApplicationCommandOptionChannel,
+	ARG_DURATION: discordgo.ApplicationCommandOptionString,
+}
+
+// ApplicationCommands describes the router's commands as slash commands, so
+// both ways of running a command share one definition
+func (router *CommandRouter) ApplicationCommands() []*discordgo.ApplicationCommand {
+	commands := make([]*discordgo.ApplicationCommand, 0, len(router.commands))
+	for _, command := range router.commands {
+		options := make([]*discordgo.ApplicationCommandOption, 0, len(command.Args))
+		for _, spec := range command.Args {
+			description := spec.Description
+			if description == "" {
+				description = spec.Name
+			}
+			option := &discordgo.ApplicationCommandOption{
+				Type:        argOptionTypes[spec.Type],
+				Name:        spec.Name,
+				Description: description,
+				Required:    !spec.Optional,
+			}
+			for _, choice := range spec.Choices {
+				option.Choices = append(option.Choices, &discordgo.ApplicationCommandOptionChoice{
+					Name:  choice,
+					Value: choice,
+				})
+			}
+			options = append(options, option)
+		}
+		commands = append(commands, &discordgo.ApplicationCommand{
+			Name:        command.Name,
+			Description: command.Description,
+			Options:     options,
+		})
+	}
+	return commands
+}
+
+// interactionArgs reads the options of a slash command into the same shape
+// ParseArgs produces for text commands
+func interactionArgs(command *Command, options []*discordgo.ApplicationCommandInteractionDataOption) (map[string]interface{}, error) {
+	args := make(map[string]interface{})
+	for _, option := range options {
+		for _, spec := range command.Args {
+			if spec.Name != option.Name {
+				continue
+			}
+			var value string
+			switch option.Type {
+			case discordgo.ApplicationCommandOptionInteger:
+				value = fmt.Sprint(option.IntValue())
+			case discordgo.ApplicationCommandOptionUser:
+				value = option.UserValue(nil).ID
+			case discordgo.ApplicationCommandOptionChannel:
+				value = option.ChannelValue(nil).ID
+			default:
+				value = option.StringValue()
+			}
+			parsed, err := parseArg(spec, value)
+			if err != nil {
+				return nil, err
+			}
+			args[spec.Name] = parsed
+		}
+	}
+	return args, nil
+}
+
+func RegisterApplicationCommands(s *discordgo.Session) error {
+	_, err := s.ApplicationCommandBulkOverwrite(s.State.User.ID, "", Commands.ApplicationCommands())
+	return err
+}
+
+// interactionReply answers the deferred response with the first reply and
+// sends anything after that as follow ups
+type interactionReply struct {
+	session     *discordgo.Session
+	interaction *discordgo.Interaction
+	responded   bool
+	// Only the user who ran the command sees ephemeral replies
+	ephemeral bool
+}
+
+func (reply *interactionReply) Send(content string) error {
+	if !reply.responded {
+		reply.responded = true
+		_, err := reply.session.InteractionResponseEdit(reply.interaction, &discordgo.WebhookEdit{
+			Content:         &content,
+			AllowedMentions: &discordgo.MessageAllowedMentions{},
+		})
+		return err
+	}
+	params := &discordgo.WebhookParams{Content: content}
+	if reply.ephemeral {
+		params.Flags = discordgo.MessageFlagsEphemeral
+	}
+	_, err := reply.session.FollowupMessageCreate(reply.interaction, false, params)
+	return err
+}
+
+func InteractionCreateHandler(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+	data := i.ApplicationCommandData()
+	command := Commands.Lookup(data.Name)
+	if command == nil {
+		return
+	}
+	// Scrapes can take longer than the few seconds we get to respond in
+	response := &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	}
+	if command.Private {
+		// The deferred response decides whether the edited reply is ephemeral
+		response.Data = &discordgo.InteractionResponseData{Flags: discordgo.MessageFlagsEphemeral}
+	}
+	err := s.InteractionRespond(i.Interaction, response)
+	if err != nil {
+		log.Default().Println("Unable to respond to interaction", data.Name, err)
+		return
+	}
+
+	db := ConnectToDB()
+	reply := &interactionReply{session: s, interaction: i.Interaction, ephemeral: command.Private}
+	ctx := &CommandContext{
+		Session:   s,
+		DB:        db,
+		Router:    Commands,
+		GuildID:   i.GuildID,
+		ChannelID: i.ChannelID,
+		Respond:   reply.Send,
+	}
+	if i.Member != nil {
+		ctx.AuthorID = i.Member.User.ID
+		ctx.RoleIDs = i.Member.Roles
+	} else if i.User != nil {
+		ctx.AuthorID = i.User.ID
+	}
+	ctx.Guild, err = GetGuildSettings(db, i.GuildID)
+	if err != nil {
+		Commands.report(ctx, err)
+		return
+	}
+	ctx.Args, err = interactionArgs(command, data.Options)
+	if err != nil {
+		Commands.report(ctx, commandErrorf("%s", err))
+		return
+	}
+	Commands.report(ctx, Commands.Run(ctx, command, nil))
+	if !reply.responded {
+		// Otherwise discord shows the bot thinking forever
+		reply.Send("Done")
+	}
+}
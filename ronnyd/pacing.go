@@ -0,0 +1,86 @@
+package ronnyd
+
+import (
+	"fmt"
+	"time"
+	"unicode/utf8"
+)
+
+// Replays wait for the original gap between messages times
+// PLAYBACK_PACE_SCALE, kept between the min and max delay so a session
+// neither floods the channel nor stalls on a long pause
+const PLAYBACK_PACE_SCALE = 0.5
+const PLAYBACK_MIN_DELAY = 1 * time.Second
+const PLAYBACK_MAX_DELAY = 15 * time.Second
+
+// How long we show the typing indicator for, based on the message's length.
+// Discord stops showing it after 10 seconds anyway.
+const PLAYBACK_TYPING_CHARS_PER_SECOND = 25
+const PLAYBACK_MAX_TYPING = 8 * time.Second
+
+// Clock is how playback tells the time and waits
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// PlaybackClock can be swapped out so tests can check pacing without waiting
+var PlaybackClock Clock = systemClock{}
+
+// PlaybackDelay is how long to wait before replaying message after previous,
+// which is nil for the first message
+func PlaybackDelay(previous *Message, message *Message) time.Duration {
+	if previous == nil {
+		return 0
+	}
+	gap := message.MessageTimestamp.Sub(previous.MessageTimestamp)
+	delay := time.Duration(float64(gap) * PLAYBACK_PACE_SCALE)
+	if delay < PLAYBACK_MIN_DELAY {
+		return PLAYBACK_MIN_DELAY
+	}
+	if delay > PLAYBACK_MAX_DELAY {
+		return PLAYBACK_MAX_DELAY
+	}
+	return delay
+}
+
+// TypingDuration is roughly how long the message would take to type
+func TypingDuration(message *Message) time.Duration {
+	typing := time.Duration(utf8.RuneCountInString(message.Content)) * time.Second / PLAYBACK_TYPING_CHARS_PER_SECOND
+	if typing > PLAYBACK_MAX_TYPING {
+		return PLAYBACK_MAX_TYPING
+	}
+	return typing
+}
+
+// pacePlayback waits until it's time to send message, showing the bot typing
+// for the end of the wait
+func pacePlayback(s Discord, target *playbackTarget, previous *Message, message *Message) {
+	delay := PlaybackDelay(previous, message)
+	typing := TypingDuration(message)
+	if delay > typing {
+		PlaybackClock.Sleep(delay - typing)
+	}
+	if typing == 0 {
+		return
+	}
+	// A webhook posts as the author, so the bot typing would give it away
+	if target.Webhook == nil {
+		err := s.ChannelTyping(target.ChannelID)
+		if err != nil {
+			// Not worth stopping the playback over
+			fmt.Println("Unable to show typing", target.ChannelID, err)
+		}
+	}
+	PlaybackClock.Sleep(typing)
+}
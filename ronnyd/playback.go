@@ -1,62 +1,395 @@
 package ronnyd
 
 import (
+	"errors"
 	"fmt"
-	"os"
-	"sort"
+	"log"
+	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/bwmarrin/discordgo"
 	"gorm.io/gorm"
 )
 
+// Playbacks in a guild go one at a time since they share its cooldowns and
+// quotas, but one that's pacing its messages doesn't hold up other guilds
 var playbackMutex sync.Mutex
+var guildPlaybackMutexes = make(map[string]*sync.Mutex)
+
+// lockGuildPlayback waits for the guild's other playbacks, returning the func
+// to let the next one go
+func lockGuildPlayback(guildID string) func() {
+	playbackMutex.Lock()
+	guildMutex, ok := guildPlaybackMutexes[guildID]
+	if !ok {
+		guildMutex = &sync.Mutex{}
+		guildPlaybackMutexes[guildID] = guildMutex
+	}
+	playbackMutex.Unlock()
+	guildMutex.Lock()
+	return guildMutex.Unlock
+}
 
 func SelectMessageGroupForPlayback(db *gorm.DB, authorID string) []*Message {
-	messageMap := GetMessagesForPlayback(db, authorID)
+	return SelectGuildMessageGroupForPlayback(db, authorID, DefaultGuildSettings())
+}
 
-	keys := make([]time.Time, 0, len(messageMap))
-	for k := range messageMap {
-		keys = append(keys, k)
-	}
-	sort.Slice(keys, func(i, j int) bool {
-		return keys[i].Before(keys[j])
-	})
-	lastKey := len(keys) - 1
-	return messageMap[keys[lastKey]]
+func SelectGuildMessageGroupForPlayback(db *gorm.DB, authorID string, guild *Guild) []*Message {
+	return loadForPlayback(db, SelectSession(GetGuildMessagesForPlayback(db, authorID, guild), &NewestSelector{}))
 }
 
+// How many times we try sending a replayed message, and how long to wait
+// before the first retry. The wait doubles each time.
+const PLAYBACK_SEND_ATTEMPTS = 4
+const PLAYBACK_RETRY_BACKOFF = 2 * time.Second
+
+var errNothingToReplay = errors.New("nothing to replay")
+
+// PlaybackMessages sends the messages without recording a run. Messages are
+// only marked as replayed once discord has accepted them, and a message that
+// can't be sent doesn't stop the rest.
 func PlaybackMessages(s Discord, db *gorm.DB, messages []*Message) []*Message {
+	store := OpenBlobStore()
+	destinations := make(map[uint]string)
 	var messagesReplayed []*Message
+	var previous *Message
 	for _, message := range messages {
-		err := MarkMessageAsReplayed(db, message)
+		destination, err := playbackDestination(s, db, destinations, message)
 		if err != nil {
-			fmt.Println("Failed to mark message as replayed", message.ID)
+			fmt.Println("Unable to find somewhere to replay message", message.ID, err)
+			continue
+		}
+		_, err = sendPlaybackMessage(s, db, store, &playbackTarget{ChannelID: destination}, previous, message)
+		if err == errNothingToReplay {
+			fmt.Println("Nothing to replay for message", message.ID)
 			continue
 		}
-
-		_, err = s.ChannelMessageSend(message.Channel.DiscordID, message.Content)
 		if err != nil {
-			fmt.Println("Error sending message", err)
-			return messagesReplayed
+			fmt.Println("Error sending message", message.ID, err)
+			continue
+		}
+		err = MarkMessageAsReplayed(db, message)
+		if err != nil {
+			fmt.Println("Failed to mark message as replayed", message.ID, err)
 		}
 		messagesReplayed = append(messagesReplayed, message)
+		previous = message
+	}
+	return messagesReplayed
+}
+
+func playbackDestination(s Discord, db *gorm.DB, destinations map[uint]string, message *Message) (string, error) {
+	if destination, ok := destinations[message.ChannelID]; ok {
+		return destination, nil
+	}
+	destination, err := PlaybackChannelID(s, db, &message.Channel)
+	if err != nil {
+		return "", err
+	}
+	destinations[message.ChannelID] = destination
+	return destination, nil
+}
 
-		if os.Getenv("ENV") != "test" {
-			time.Sleep(1 * time.Second)
+// retryDelay says how long to wait before sending again, or false when
+// retrying won't help, e.g. we aren't allowed to post in the channel
+func retryDelay(err error, attempt int) (time.Duration, bool) {
+	var rateLimited *discordgo.RateLimitError
+	if errors.As(err, &rateLimited) {
+		return rateLimited.RetryAfter, true
+	}
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Response != nil {
+		status := restErr.Response.StatusCode
+		if status != http.StatusTooManyRequests && status < http.StatusInternalServerError {
+			return 0, false
+		}
+		retryAfter, convErr := strconv.ParseFloat(restErr.Response.Header.Get("Retry-After"), 64)
+		if convErr == nil {
+			return time.Duration(retryAfter * float64(time.Second)), true
 		}
 	}
-	return messagesReplayed
+	return PLAYBACK_RETRY_BACKOFF << attempt, true
+}
+
+// sendPlaybackMessage sends one replayed message, paced after previous,
+// retrying when discord is rate limiting us or having problems. It goes
+// through the target's webhook when it has one, and as the bot if the webhook
+// has been deleted.
+func sendPlaybackMessage(s Discord, db *gorm.DB, store BlobStore, target *playbackTarget, previous *Message, message *Message) (*discordgo.Message, error) {
+	var err error
+	paced := false
+	for attempt := 0; attempt < PLAYBACK_SEND_ATTEMPTS; attempt++ {
+		// Built fresh each attempt since sending uses up the files' readers
+		data := playbackMessageSend(store, message)
+		if data.Content == "" && len(data.Files) == 0 {
+			return nil, errNothingToReplay
+		}
+		// Only once we know there's something to send, and not again for
+		// retries
+		if !paced {
+			pacePlayback(s, target, previous, message)
+			paced = true
+		}
+		var sent *discordgo.Message
+		if target.Webhook != nil {
+			sent, err = executePlaybackWebhook(s, db, target, message, data)
+			closePlaybackFiles(data)
+			if isNotFound(err) {
+				target.Webhook = nil
+				attempt--
+				continue
+			}
+		} else {
+			sent, err = s.ChannelMessageSendComplex(target.ChannelID, data)
+			closePlaybackFiles(data)
+		}
+		if err == nil {
+			return sent, nil
+		}
+		delay, retry := retryDelay(err, attempt)
+		if !retry || attempt == PLAYBACK_SEND_ATTEMPTS-1 {
+			break
+		}
+		fmt.Println("Retrying message", message.ID, "in", delay, err)
+		PlaybackClock.Sleep(delay)
+	}
+	return nil, err
+}
+
+// PlaybackBlockedError is returned when a playback isn't allowed yet
+type PlaybackBlockedError struct {
+	Reason    string
+	Remaining time.Duration
+}
+
+func (err *PlaybackBlockedError) Error() string {
+	if err.Remaining <= 0 {
+		// Waiting won't help
+		return err.Reason
+	}
+	return fmt.Sprintf("%s, try again in %s", err.Reason, err.Remaining.Round(time.Minute))
+}
+
+type PlaybackRequest struct {
+	TargetID string
+	// Only the guild's messages are replayed, unless it's the default settings
+	Guild *Guild
+	// Discord ID of whoever asked for the playback
+	TriggeredBy string
+	// Overrides the guild's session grouping when set
+	Grouping string
+	// Which session gets replayed, the newest when unset. Seed makes random
+	// selections repeatable.
+	Selection string
+	Seed      int64
+	// Replays this stored PlaybackSession instead of picking one, it should
+	// belong to TargetID
+	SessionID uint
+	// Replays into this channel rather than the one the session was in, or
+	// the guild's mapped destination for it
+	DestinationChannelID string
+	// Replays into a new thread in the destination
+	MemoryLane bool
 }
 
 func RunPlayback(d Discord, targetID string) []*Message {
+	run, err := RunGuildPlayback(d, targetID, "")
+	if err != nil {
+		fmt.Println("Unable to run playback", targetID, err)
+	}
+	if run == nil {
+		return nil
+	}
+	return run.Replayed
+}
+
+// RunGuildPlayback replays a session from the guild using its settings, or
+// from anywhere when guildID is empty
+func RunGuildPlayback(d Discord, targetID string, guildID string) (*PlaybackRun, error) {
 	db := ConnectToDB()
+	guild, err := GetGuildSettings(db, guildID)
+	if err != nil {
+		return nil, err
+	}
+	return RunPlaybackRequest(d, db, &PlaybackRequest{TargetID: targetID, Guild: guild})
+}
 
-	playbackMutex.Lock()
-	defer playbackMutex.Unlock()
+// LastReplayedAt is when we last replayed one of the author's messages from
+// the guild, or the zero time if we never have
+func LastReplayedAt(db *gorm.DB, authorID string, guildID string) time.Time {
+	var lastReplayedAt time.Time
+	db.Model(&Message{}).Select(
+		"COALESCE(MAX(messages.replayed_at), ?)", time.Time{},
+	).Joins(
+		"JOIN authors ON authors.id = messages.author_id",
+	).Joins(
+		"JOIN channels ON channels.id = messages.channel_id",
+	).Where(
+		"authors.discord_id = ? AND channels.guild_id = ?", authorID, guildID,
+	).Row().Scan(&lastReplayedAt)
+	return lastReplayedAt
+}
 
-	// TODO: Make sure we haven't replayed a message from target inside some cooldown period
-	messages := SelectMessageGroupForPlayback(db, targetID)
-	messagesReplayed := PlaybackMessages(d, db, messages)
-	return messagesReplayed
+// RunPlaybackRequest replays a session, recording how it went as a
+// PlaybackRun. The session is queued up before anything is sent, so an
+// interrupted playback can be picked up again by ResumePlaybackRuns. The run
+// is returned along with any error.
+func RunPlaybackRequest(d Discord, db *gorm.DB, request *PlaybackRequest) (*PlaybackRun, error) {
+	unlock := lockGuildPlayback(request.Guild.DiscordID)
+	defer unlock()
+
+	run, err := StartPlaybackRun(db, request)
+	if err != nil {
+		return nil, err
+	}
+	err = queuePlayback(d, db, request, run)
+	if err == nil {
+		err = deliverPlaybackRun(d, db, run)
+	}
+	return run, completePlaybackRun(db, run, err)
+}
+
+func queuePlayback(d Discord, db *gorm.DB, request *PlaybackRequest, run *PlaybackRun) error {
+	// Playback without a guild is for testing from the command line, so only
+	// guild playback has cooldowns and quotas
+	guildPlayback := request.Guild.DiscordID != ""
+	now := PlaybackClock.Now()
+	if guildPlayback {
+		err := CheckPlaybackQuota(db, request.Guild, now)
+		if err == nil {
+			err = CheckTargetCooldown(db, request.Guild, request.TargetID, now)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	messages, err := selectPlaybackMessages(db, request)
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	err = resolveDestination(d, db, request, run, messages)
+	if err != nil {
+		return err
+	}
+	if guildPlayback {
+		err := CheckChannelCooldown(db, request.Guild, run.cooldownChannelID(messages[0].Channel.DiscordID), now)
+		if err != nil {
+			return err
+		}
+	}
+	// Only once nothing's going to stop the playback, so we don't leave an
+	// empty thread behind
+	if request.MemoryLane {
+		run.MemoryLaneThreadID, err = startMemoryLane(d, run.ReplayIntoChannelID, &messages[0].Author, messages[0].MessageTimestamp)
+		if err != nil {
+			return err
+		}
+		run.DestinationChannelID = run.MemoryLaneThreadID
+	}
+	return run.queue(db, messages)
+}
+
+func selectPlaybackMessages(db *gorm.DB, request *PlaybackRequest) ([]*Message, error) {
+	if request.SessionID != 0 {
+		return SessionMessagesForPlayback(db, request.SessionID), nil
+	}
+	grouper := request.Guild.Grouper()
+	if request.Grouping != "" {
+		var err error
+		grouper, err = NewSessionGrouper(request.Grouping, request.Guild)
+		if err != nil {
+			return nil, err
+		}
+	}
+	selector, err := NewSessionSelector(request.Selection, request.Seed)
+	if err != nil {
+		return nil, err
+	}
+	guild := request.Guild
+	if request.DestinationChannelID != "" {
+		// Any session can go to a destination playback is allowed in, which
+		// is checked once we have it
+		unfiltered := *guild
+		unfiltered.AllowedPlaybackChannelIDs = nil
+		guild = &unfiltered
+	}
+	return loadForPlayback(db, SelectSession(GroupMessagesForPlayback(db, request.TargetID, guild, grouper), selector)), nil
+}
+
+// completePlaybackRun records the outcome of the run, and starts the
+// cooldowns if anything was sent
+func completePlaybackRun(db *gorm.DB, run *PlaybackRun, err error) error {
+	finishErr := run.finish(db, err)
+	if finishErr != nil {
+		fmt.Println("Unable to record playback run", run.ID, finishErr)
+	}
+	sessionErr := RefreshPlaybackSessionsReplayed(db, run.sentMessageIDs(db))
+	if sessionErr != nil {
+		fmt.Println("Unable to update replayed sessions", run.ID, sessionErr)
+	}
+	if run.GuildID != "" && run.SentCount(db) > 0 {
+		recordErr := RecordPlayback(db, run.GuildID, run.TargetID, run.cooldownChannelID(run.SourceChannelID), run.StartedAt)
+		if recordErr != nil {
+			fmt.Println("Unable to record playback cooldown", run.TargetID, recordErr)
+		}
+	}
+	return err
+}
+
+// ResumePlaybackRuns finishes sending runs that were interrupted, e.g. by the
+// bot restarting part way through
+func ResumePlaybackRuns(d Discord, db *gorm.DB) []*PlaybackRun {
+	var runs []*PlaybackRun
+	db.Where("outcome = ?", PLAYBACK_OUTCOME_RUNNING).Order("started_at").Find(&runs)
+	resumed := make([]*PlaybackRun, 0, len(runs))
+	for _, run := range runs {
+		if resumePlaybackRun(d, db, run) {
+			resumed = append(resumed, run)
+		}
+	}
+	return resumed
+}
+
+// resumePlaybackRun finishes the run unless it's still being sent, in which
+// case it's done by the time we have the guild's lock
+func resumePlaybackRun(d Discord, db *gorm.DB, run *PlaybackRun) bool {
+	unlock := lockGuildPlayback(run.GuildID)
+	defer unlock()
+
+	var current PlaybackRun
+	db.Select("outcome").First(&current, run.ID)
+	if current.Outcome != PLAYBACK_OUTCOME_RUNNING {
+		return false
+	}
+	fmt.Println("Resuming playback", run.ID)
+	completePlaybackRun(db, run, deliverPlaybackRun(d, db, run))
+	return true
+}
+
+func resumeAndNotify(s Discord) {
+	db := ConnectToDB()
+	for _, run := range ResumePlaybackRuns(s, db) {
+		err := NotifyAdmin(s, "Resumed playback "+run.Summary())
+		if err != nil {
+			log.Default().Println("Error notifying admin", err)
+		}
+	}
+}
+
+func PlaybackSummary(messagesReplayed []*Message) string {
+	if len(messagesReplayed) == 0 {
+		return "Nothing to replay"
+	}
+	first := messagesReplayed[0]
+	return fmt.Sprintf(
+		"Replayed %d messages from %s, originally sent %s",
+		len(messagesReplayed),
+		first.Author.Name,
+		first.MessageTimestamp.Format("2 Jan 2006"),
+	)
 }
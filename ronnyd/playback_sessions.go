@@ -0,0 +1,338 @@
+package ronnyd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const PLAYBACK_SESSIONS_TO_LIST = 10
+
+// PlaybackSession is one of an author's sessions, stored so it has an ID to
+// list and replay it by. They're grouped with the guild's grouping, and kept
+// up to date as messages come in rather than recomputed for every playback.
+type PlaybackSession struct {
+	gorm.Model
+	GuildID      string `gorm:"index"`
+	AuthorID     uint   `gorm:"index"`
+	Author       Author `gorm:"constraint:OnDelete:CASCADE"`
+	ChannelID    uint
+	Channel      Channel `gorm:"constraint:OnDelete:CASCADE"`
+	StartedAt    time.Time
+	EndedAt      time.Time
+	MessageCount int
+	// Set once every message in the session has been replayed
+	ReplayedAt time.Time
+	Messages   []Message `gorm:"constraint:OnDelete:SET NULL"`
+}
+
+func isPlaybackCandidate(guild *Guild, message *Message, authorDiscordID string) bool {
+	return message.DiscordDeletedAt.IsZero() &&
+		!IsIndexCommand(message.Content, authorDiscordID) &&
+		!guild.IsCommand(message.Content)
+}
+
+func latestPlaybackSession(db *gorm.DB, guildID string, authorID uint) *PlaybackSession {
+	var session PlaybackSession
+	db.Clauses(clause.Locking{Strength: "UPDATE"}).Where(
+		"guild_id = ? AND author_id = ?", guildID, authorID,
+	).Order("started_at desc").Limit(1).Find(&session)
+	if session.ID == 0 {
+		return nil
+	}
+	return &session
+}
+
+// AddToPlaybackSession adds a newly stored message to the end of its author's
+// latest session, or starts a new one. Messages from before the latest
+// session, e.g. from a scrape, mean the author's sessions are rebuilt.
+func AddToPlaybackSession(db *gorm.DB, guild *Guild, message *Message) error {
+	var author Author
+	result := db.First(&author, message.AuthorID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if message.PlaybackSessionID != nil || !isPlaybackCandidate(guild, message, author.DiscordID) {
+		return nil
+	}
+
+	rebuild := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		session := latestPlaybackSession(tx, guild.DiscordID, message.AuthorID)
+		if session != nil && message.MessageTimestamp.Before(session.EndedAt) {
+			rebuild = true
+			return nil
+		}
+		continues := false
+		if session != nil {
+			// The message continues the session if the guild's grouping
+			// would have put it there
+			var sessionMessages []*Message
+			result := tx.Where(
+				"playback_session_id = ? AND discord_deleted_at = ?", session.ID, time.Time{},
+			).Order("message_timestamp").Find(&sessionMessages)
+			if result.Error != nil {
+				return result.Error
+			}
+			groups := guild.Grouper().Group(tx, append(sessionMessages, message))
+			continues = len(groups) > 0 && len(groups[len(groups)-1]) > 1
+		}
+		if continues {
+			session.EndedAt = message.MessageTimestamp
+			session.MessageCount++
+			// There's something new to replay now
+			session.ReplayedAt = time.Time{}
+		} else {
+			session = &PlaybackSession{
+				GuildID:      guild.DiscordID,
+				AuthorID:     message.AuthorID,
+				ChannelID:    message.ChannelID,
+				StartedAt:    message.MessageTimestamp,
+				EndedAt:      message.MessageTimestamp,
+				MessageCount: 1,
+			}
+		}
+		result := tx.Omit(clause.Associations).Save(session)
+		if result.Error != nil {
+			return result.Error
+		}
+		message.PlaybackSessionID = &session.ID
+		return tx.Model(message).Update("playback_session_id", session.ID).Error
+	})
+	if err != nil || !rebuild {
+		return err
+	}
+	return RebuildPlaybackSessions(db, guild, message.AuthorID)
+}
+
+// RebuildPlaybackSessions regroups all of an author's messages in the guild.
+// Sessions are updated in place so their IDs stay the same: each new grouping
+// keeps the ID of the first existing session its messages were in, sessions
+// merged into another are deleted, and the rest of a split session gets a new
+// one.
+func RebuildPlaybackSessions(db *gorm.DB, guild *Guild, authorID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var messages []*Message
+		result := tx.Preload("Author").Joins(
+			"JOIN channels ON channels.id = messages.channel_id",
+		).Where(
+			"messages.author_id = ? AND messages.discord_deleted_at = ?", authorID, time.Time{},
+		).Where(
+			"channels.guild_id = ?", guild.DiscordID,
+		).Order("message_timestamp").Find(&messages)
+		if result.Error != nil {
+			return result.Error
+		}
+		candidates := make([]*Message, 0, len(messages))
+		for _, message := range messages {
+			if isPlaybackCandidate(guild, message, message.Author.DiscordID) {
+				candidates = append(candidates, message)
+			}
+		}
+
+		var existing []*PlaybackSession
+		result = tx.Where("guild_id = ? AND author_id = ?", guild.DiscordID, authorID).Find(&existing)
+		if result.Error != nil {
+			return result.Error
+		}
+		unclaimed := make(map[uint]*PlaybackSession, len(existing))
+		existingIDs := make([]uint, 0, len(existing))
+		for _, session := range existing {
+			unclaimed[session.ID] = session
+			existingIDs = append(existingIDs, session.ID)
+		}
+		// Messages are put back in a session below, this drops the ones that
+		// shouldn't be in one any more
+		if len(existingIDs) > 0 {
+			result = tx.Model(&Message{}).Where("playback_session_id IN ?", existingIDs).Update("playback_session_id", nil)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		for _, messages := range guild.Grouper().Group(tx, candidates) {
+			session := &PlaybackSession{GuildID: guild.DiscordID, AuthorID: authorID}
+			for _, message := range messages {
+				if message.PlaybackSessionID == nil {
+					continue
+				}
+				if claimed, ok := unclaimed[*message.PlaybackSessionID]; ok {
+					session = claimed
+					delete(unclaimed, claimed.ID)
+					break
+				}
+			}
+			session.ChannelID = messages[0].ChannelID
+			session.StartedAt = messages[0].MessageTimestamp
+			session.EndedAt = messages[len(messages)-1].MessageTimestamp
+			session.MessageCount = len(messages)
+			session.ReplayedAt = sessionReplayedAt(messages)
+			result = tx.Omit(clause.Associations).Save(session)
+			if result.Error != nil {
+				return result.Error
+			}
+			ids := make([]uint, 0, len(messages))
+			for _, message := range messages {
+				ids = append(ids, message.ID)
+				message.PlaybackSessionID = &session.ID
+			}
+			result = tx.Model(&Message{}).Where("id IN ?", ids).Update("playback_session_id", session.ID)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+
+		if len(unclaimed) == 0 {
+			return nil
+		}
+		merged := make([]uint, 0, len(unclaimed))
+		for id := range unclaimed {
+			merged = append(merged, id)
+		}
+		return tx.Unscoped().Delete(&PlaybackSession{}, merged).Error
+	})
+}
+
+// sessionReplayedAt is when the last message was replayed, if they all have
+// been
+func sessionReplayedAt(messages []*Message) time.Time {
+	var replayedAt time.Time
+	for _, message := range messages {
+		if message.ReplayedAt.IsZero() {
+			return time.Time{}
+		}
+		if message.ReplayedAt.After(replayedAt) {
+			replayedAt = message.ReplayedAt
+		}
+	}
+	return replayedAt
+}
+
+// UpdatePlaybackSessionsForEdit regroups the author's sessions when an edit
+// turns a message into a command or back again
+func UpdatePlaybackSessionsForEdit(db *gorm.DB, message *Message, previousContent string) error {
+	var author Author
+	result := db.First(&author, message.AuthorID)
+	if result.Error != nil {
+		return result.Error
+	}
+	var channel Channel
+	result = db.First(&channel, message.ChannelID)
+	if result.Error != nil {
+		return result.Error
+	}
+	guild, err := GetGuildSettings(db, channel.GuildId)
+	if err != nil {
+		return err
+	}
+	previous := &Message{Content: previousContent}
+	if isPlaybackCandidate(guild, previous, author.DiscordID) == isPlaybackCandidate(guild, message, author.DiscordID) {
+		return nil
+	}
+	return RebuildPlaybackSessions(db, guild, message.AuthorID)
+}
+
+// EnsurePlaybackSessions builds the author's sessions if any of their
+// messages haven't been put in one, e.g. ones stored by a scrape
+func EnsurePlaybackSessions(db *gorm.DB, guild *Guild, authorID uint) error {
+	var missing []*Message
+	result := db.Preload("Author").Joins(
+		"JOIN channels ON channels.id = messages.channel_id",
+	).Where(
+		"messages.author_id = ? AND messages.playback_session_id IS NULL AND messages.discord_deleted_at = ?",
+		authorID,
+		time.Time{},
+	).Where(
+		"channels.guild_id = ?", guild.DiscordID,
+	).Find(&missing)
+	if result.Error != nil {
+		return result.Error
+	}
+	for _, message := range missing {
+		// Commands never get a session
+		if isPlaybackCandidate(guild, message, message.Author.DiscordID) {
+			return RebuildPlaybackSessions(db, guild, authorID)
+		}
+	}
+	return nil
+}
+
+// RefreshPlaybackSessionsReplayed brings the replayed state of the sessions
+// the messages are in up to date
+func RefreshPlaybackSessionsReplayed(db *gorm.DB, messageIDs []uint) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+	return db.Exec(`
+UPDATE playback_sessions SET replayed_at = COALESCE((
+	SELECT MAX(messages.replayed_at) FROM messages
+	WHERE messages.playback_session_id = playback_sessions.id AND messages.discord_deleted_at = ?
+	HAVING MIN(messages.replayed_at) > ?
+), ?)
+WHERE id IN (SELECT playback_session_id FROM messages WHERE id IN ?)`,
+		time.Time{},
+		time.Time{},
+		time.Time{},
+		messageIDs,
+	).Error
+}
+
+func GetPlaybackSessions(db *gorm.DB, guildID string, authorID uint, limit int) []*PlaybackSession {
+	var sessions []*PlaybackSession
+	db.Preload("Author").Preload("Channel").Where(
+		"guild_id = ? AND author_id = ?", guildID, authorID,
+	).Order("started_at desc").Limit(limit).Find(&sessions)
+	return sessions
+}
+
+func GetPlaybackSession(db *gorm.DB, sessionID uint) *PlaybackSession {
+	var session PlaybackSession
+	db.Preload("Author").Preload("Channel").Limit(1).Find(&session, sessionID)
+	if session.ID == 0 {
+		return nil
+	}
+	return &session
+}
+
+// SessionMessagesForPlayback is what's left to replay of a stored session
+func SessionMessagesForPlayback(db *gorm.DB, sessionID uint) []*Message {
+	var messages []*Message
+	preloadForPlayback(db).Where(
+		"messages.playback_session_id = ?", sessionID,
+	).Where(
+		"messages.replayed_at = ?", time.Time{},
+	).Where(
+		"messages.discord_deleted_at = ?", time.Time{},
+	).Order("message_timestamp").Find(&messages)
+	return messages
+}
+
+func (session *PlaybackSession) Summary() string {
+	replayed := "not replayed"
+	if !session.ReplayedAt.IsZero() {
+		replayed = "replayed " + session.ReplayedAt.Format("2006-01-02")
+	}
+	return fmt.Sprintf(
+		"#%d %s in <#%s>: %d messages over %s, %s",
+		session.ID,
+		session.StartedAt.Format("2006-01-02 15:04"),
+		session.Channel.DiscordID,
+		session.MessageCount,
+		session.EndedAt.Sub(session.StartedAt).Round(time.Minute),
+		replayed,
+	)
+}
+
+func FormatPlaybackSessions(sessions []*PlaybackSession) string {
+	if len(sessions) == 0 {
+		return "No sessions found"
+	}
+	lines := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		lines = append(lines, session.Summary())
+	}
+	return strings.Join(lines, "\n")
+}
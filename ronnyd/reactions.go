@@ -0,0 +1,170 @@
+package ronnyd
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reaction is the count for one emoji on a message. Users is only filled in
+// for reactions we saw happen, scraped history only gives us counts.
+type Reaction struct {
+	gorm.Model
+	MessageID uint `gorm:"uniqueIndex:idx_message_emoji"`
+	// The custom emoji ID, or the emoji itself for unicode emoji
+	EmojiKey  string `gorm:"uniqueIndex:idx_message_emoji"`
+	EmojiID   string
+	EmojiName string
+	Count     int
+	Users     []ReactionUser `gorm:"constraint:OnDelete:CASCADE"`
+}
+
+type ReactionUser struct {
+	gorm.Model
+	ReactionID    uint   `gorm:"uniqueIndex:idx_reaction_user"`
+	UserDiscordID string `gorm:"uniqueIndex:idx_reaction_user"`
+}
+
+func emojiKey(emoji *discordgo.Emoji) string {
+	if emoji.ID != "" {
+		return emoji.ID
+	}
+	return emoji.Name
+}
+
+func findReactedMessage(tx *gorm.DB, messageDiscordID string) *Message {
+	var message Message
+	tx.Clauses(
+		clause.Locking{Strength: "UPDATE"},
+	).Limit(1).Find(&message, "discord_id = ?", messageDiscordID)
+	if message.ID == 0 {
+		return nil
+	}
+	return &message
+}
+
+func updateReactionCount(tx *gorm.DB, message *Message) error {
+	return tx.Model(message).Update(
+		"reaction_count",
+		tx.Model(&Reaction{}).Select("COALESCE(SUM(count), 0)").Where("message_id = ?", message.ID),
+	).Error
+}
+
+// AddReaction records a user reacting to a stored message, ignoring
+// reactions to messages we don't have
+func AddReaction(db *gorm.DB, messageDiscordID string, userDiscordID string, emoji *discordgo.Emoji) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		message := findReactedMessage(tx, messageDiscordID)
+		if message == nil {
+			return nil
+		}
+		reaction := Reaction{MessageID: message.ID, EmojiKey: emojiKey(emoji)}
+		result := tx.Where(reaction).Attrs(Reaction{
+			EmojiID:   emoji.ID,
+			EmojiName: emoji.Name,
+		}).FirstOrCreate(&reaction)
+		if result.Error != nil {
+			return result.Error
+		}
+		result = tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&ReactionUser{
+			ReactionID:    reaction.ID,
+			UserDiscordID: userDiscordID,
+		})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		result = tx.Model(&reaction).Update("count", gorm.Expr("count + 1"))
+		if result.Error != nil {
+			return result.Error
+		}
+		return updateReactionCount(tx, message)
+	})
+}
+
+func RemoveReaction(db *gorm.DB, messageDiscordID string, userDiscordID string, emoji *discordgo.Emoji) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		message := findReactedMessage(tx, messageDiscordID)
+		if message == nil {
+			return nil
+		}
+		var reaction Reaction
+		tx.Limit(1).Find(&reaction, "message_id = ? AND emoji_key = ?", message.ID, emojiKey(emoji))
+		if reaction.ID == 0 {
+			return nil
+		}
+		tx.Unscoped().Where(
+			"reaction_id = ? AND user_discord_id = ?", reaction.ID, userDiscordID,
+		).Delete(&ReactionUser{})
+		// Still decrement when we never saw the user react, since the count
+		// may have come from a scrape
+		if reaction.Count <= 1 {
+			result := tx.Unscoped().Delete(&reaction)
+			if result.Error != nil {
+				return result.Error
+			}
+		} else {
+			result := tx.Model(&reaction).Update("count", gorm.Expr("count - 1"))
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		return updateReactionCount(tx, message)
+	})
+}
+
+func RemoveAllReactions(db *gorm.DB, messageDiscordID string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		message := findReactedMessage(tx, messageDiscordID)
+		if message == nil {
+			return nil
+		}
+		result := tx.Unscoped().Where("message_id = ?", message.ID).Delete(&Reaction{})
+		if result.Error != nil {
+			return result.Error
+		}
+		return updateReactionCount(tx, message)
+	})
+}
+
+// syncReactionCounts overwrites our counts with the ones discord reports on
+// a fetched message. Who reacted is kept for emoji that are still there.
+func syncReactionCounts(tx *gorm.DB, message *Message, reactions []*discordgo.MessageReactions) error {
+	keys := make([]string, 0, len(reactions))
+	for _, messageReaction := range reactions {
+		key := emojiKey(messageReaction.Emoji)
+		keys = append(keys, key)
+		reaction := Reaction{MessageID: message.ID, EmojiKey: key}
+		result := tx.Where(reaction).Assign(Reaction{
+			EmojiID:   messageReaction.Emoji.ID,
+			EmojiName: messageReaction.Emoji.Name,
+			Count:     messageReaction.Count,
+		}).FirstOrCreate(&reaction)
+		if result.Error != nil {
+			return result.Error
+		}
+	}
+	stale := tx.Unscoped().Where("message_id = ?", message.ID)
+	if len(keys) > 0 {
+		stale = stale.Where("emoji_key NOT IN ?", keys)
+	}
+	result := stale.Delete(&Reaction{})
+	if result.Error != nil {
+		return result.Error
+	}
+	return updateReactionCount(tx, message)
+}
+
+func GetReactions(db *gorm.DB, messageID uint) []*Reaction {
+	var reactions []*Reaction
+	db.Preload("Users").Order("count desc").Find(&reactions, "message_id = ?", messageID)
+	return reactions
+}
+
+// SessionReactionCount is how much the server loved a playback session
+func SessionReactionCount(messages []*Message) int {
+	total := 0
+	for _, message := range messages {
+		total += message.ReactionCount
+	}
+	return total
+}
@@ -0,0 +1,77 @@
+package ronnyd
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+// Guards against reference cycles, which discord shouldn't give us but
+// would otherwise loop forever
+const MAX_REPLY_CHAIN_LENGTH = 50
+
+// resolveMessageReference fills in which message msg is replying to, storing
+// the referenced message first when discord sent it along and we don't have
+// it yet
+func resolveMessageReference(db *gorm.DB, newMessage *Message, msg *discordgo.Message) {
+	if msg.MessageReference == nil || msg.MessageReference.MessageID == "" {
+		return
+	}
+	newMessage.ReferencedDiscordID = msg.MessageReference.MessageID
+
+	if msg.ReferencedMessage != nil && msg.ReferencedMessage.Author != nil {
+		referencedMessage := msg.ReferencedMessage
+		if referencedMessage.ChannelID == "" {
+			referencedMessage.ChannelID = msg.MessageReference.ChannelID
+		}
+		_, err := PersistMessageToDb(db, referencedMessage)
+		if err != nil {
+			log.Default().Println("Error persisting referenced message", referencedMessage.ID, err)
+		}
+	}
+
+	var referencedMessage Message
+	db.Limit(1).Find(&referencedMessage, "discord_id = ?", newMessage.ReferencedDiscordID)
+	if referencedMessage.ID != 0 {
+		newMessage.ReferencedMessageID = &referencedMessage.ID
+	}
+}
+
+// linkReplies points replies we stored before the message they reference at
+// it, which is the usual order when scraping backwards
+func linkReplies(tx *gorm.DB, message *Message) error {
+	return tx.Model(&Message{}).Where(
+		"referenced_discord_id = ? AND referenced_message_id IS NULL", message.DiscordID,
+	).Update("referenced_message_id", message.ID).Error
+}
+
+// GetReplyChain returns the conversation leading up to a message, starting
+// from the message that began the chain and ending with the message itself
+func GetReplyChain(db *gorm.DB, message *Message) []*Message {
+	chain := []*Message{message}
+	current := message
+	for current.ReferencedMessageID != nil && len(chain) < MAX_REPLY_CHAIN_LENGTH {
+		var parent Message
+		db.Preload("Author").Limit(1).Find(&parent, "id = ?", *current.ReferencedMessageID)
+		if parent.ID == 0 {
+			break
+		}
+		chain = append([]*Message{&parent}, chain...)
+		current = &parent
+	}
+	return chain
+}
+
+// replyQuote shows what a replayed message was replying to, since the
+// original reply won't mean anything out of context
+func replyQuote(message *Message) string {
+	parent := message.ReferencedMessage
+	if parent == nil || parent.AuthorID == message.AuthorID {
+		return ""
+	}
+	content := truncate(strings.SplitN(parent.Content, "\n", 2)[0], 100)
+	return fmt.Sprintf("> **%s**: %s", parent.Author.Name, content)
+}
@@ -0,0 +1,173 @@
+package ronnyd
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MessageRevision is one version of a message's content. Revision 0 is what
+// was originally posted, every edit adds the next one.
+type MessageRevision struct {
+	gorm.Model
+	MessageID uint `gorm:"uniqueIndex:idx_message_revision"`
+	Revision  int  `gorm:"uniqueIndex:idx_message_revision"`
+	Content   string
+	// When this content was written, the message timestamp for the original
+	// and the edited timestamp for everything after
+	RevisedAt time.Time
+}
+
+func createRevision(tx *gorm.DB, message *Message, content string, revisedAt time.Time) (*MessageRevision, error) {
+	var latestRevision MessageRevision
+	tx.Order("revision desc").Limit(1).Find(&latestRevision, "message_id = ?", message.ID)
+	revision := &MessageRevision{
+		MessageID: message.ID,
+		Content:   content,
+		RevisedAt: revisedAt,
+	}
+	if latestRevision.ID != 0 {
+		revision.Revision = latestRevision.Revision + 1
+	}
+	result := tx.Create(revision)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	result = tx.Model(message).Update("current_revision_id", revision.ID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return revision, nil
+}
+
+func GetMessageRevisions(db *gorm.DB, messageID uint) []*MessageRevision {
+	var revisions []*MessageRevision
+	db.Order("revision").Find(&revisions, "message_id = ?", messageID)
+	return revisions
+}
+
+// FoldDuplicateMessages cleans up after the old edit handling, which inserted a
+// new message row for every edit. The first row for each discord ID is kept as
+// the canonical message. Every row's content is merged in with the revisions
+// the rows already have, in the order they were written.
+func FoldDuplicateMessages(db *gorm.DB) (int, error) {
+	var discordIDs []string
+	result := db.Model(&Message{}).Group("discord_id").Having("COUNT(*) > 1").Pluck("discord_id", &discordIDs)
+	if result.Error != nil {
+		return 0, result.Error
+	}
+
+	for _, discordID := range discordIDs {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var rows []*Message
+			result := tx.Clauses(
+				clause.Locking{Strength: "UPDATE"},
+			).Order("id").Find(&rows, "discord_id = ?", discordID)
+			if result.Error != nil {
+				return result.Error
+			}
+			canonical := rows[0]
+			rowIDs := make([]uint, 0, len(rows))
+			for _, row := range rows {
+				rowIDs = append(rowIDs, row.ID)
+			}
+			var revisions []*MessageRevision
+			result = tx.Order("revision").Find(&revisions, "message_id IN ?", rowIDs)
+			if result.Error != nil {
+				return result.Error
+			}
+
+			for i, row := range rows {
+				// The duplicate rows were stamped with the edit time rather than
+				// the original message time. Rows with revisions of their own
+				// already have their content in the latest one.
+				if row.CurrentRevisionID == nil && !hasRevision(revisions, row.Content, row.MessageTimestamp) {
+					revisions = append(revisions, &MessageRevision{Content: row.Content, RevisedAt: row.MessageTimestamp})
+				}
+				if i == 0 {
+					continue
+				}
+				if row.MessageTimestamp.After(canonical.EditedAt) {
+					canonical.EditedAt = row.MessageTimestamp
+				}
+				if row.ReplayedAt.After(canonical.ReplayedAt) {
+					canonical.ReplayedAt = row.ReplayedAt
+				}
+				if row.DiscordDeletedAt.After(canonical.DiscordDeletedAt) {
+					canonical.DiscordDeletedAt = row.DiscordDeletedAt
+					canonical.DeletedByModerator = row.DeletedByModerator
+				}
+			}
+			sort.SliceStable(revisions, func(i, j int) bool {
+				return revisions[i].RevisedAt.Before(revisions[j].RevisedAt)
+			})
+
+			// Moved onto the canonical message, and out of the way of the
+			// numbers they're about to be given
+			result = tx.Model(&MessageRevision{}).Where("message_id IN ?", rowIDs).Updates(map[string]interface{}{
+				"message_id": canonical.ID,
+				"revision":   gorm.Expr("-id"),
+			})
+			if result.Error != nil {
+				return result.Error
+			}
+			for i, revision := range revisions {
+				revision.MessageID = canonical.ID
+				revision.Revision = i
+				result = tx.Save(revision)
+				if result.Error != nil {
+					return result.Error
+				}
+			}
+			latest := revisions[len(revisions)-1]
+			canonical.Content = latest.Content
+			canonical.CurrentRevisionID = &latest.ID
+			if latest.RevisedAt.After(canonical.EditedAt) && len(revisions) > 1 {
+				canonical.EditedAt = latest.RevisedAt
+			}
+
+			result = tx.Omit(clause.Associations).Save(canonical)
+			if result.Error != nil {
+				return result.Error
+			}
+			return tx.Unscoped().Where(
+				"discord_id = ? AND id != ?", discordID, canonical.ID,
+			).Delete(&Message{}).Error
+		})
+		if err != nil {
+			return 0, err
+		}
+		log.Default().Println("Folded duplicate message rows", discordID)
+	}
+	return len(discordIDs), nil
+}
+
+func hasRevision(revisions []*MessageRevision, content string, revisedAt time.Time) bool {
+	for _, revision := range revisions {
+		if revision.Content == content && revision.RevisedAt.Equal(revisedAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// BackfillMessageRevisions gives every message stored before revisions
+// existed its original revision
+func BackfillMessageRevisions(db *gorm.DB) (int, error) {
+	backfilled := 0
+	var messages []*Message
+	result := db.Where("current_revision_id IS NULL").FindInBatches(&messages, 500, func(tx *gorm.DB, batch int) error {
+		for _, message := range messages {
+			_, err := createRevision(db, message, message.Content, message.MessageTimestamp)
+			if err != nil {
+				return err
+			}
+			backfilled++
+		}
+		return nil
+	})
+	return backfilled, result.Error
+}
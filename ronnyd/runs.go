@@ -0,0 +1,423 @@
+package ronnyd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	PLAYBACK_OUTCOME_RUNNING   = "running"
+	PLAYBACK_OUTCOME_COMPLETED = "completed"
+	// Some messages were sent before something went wrong
+	PLAYBACK_OUTCOME_PARTIAL = "partial"
+	PLAYBACK_OUTCOME_FAILED  = "failed"
+	PLAYBACK_OUTCOME_BLOCKED = "blocked"
+	PLAYBACK_OUTCOME_EMPTY   = "empty"
+	// The messages we sent were deleted again
+	PLAYBACK_OUTCOME_UNDONE = "undone"
+)
+
+const (
+	PLAYBACK_ITEM_PENDING = "pending"
+	PLAYBACK_ITEM_SENT    = "sent"
+	PLAYBACK_ITEM_FAILED  = "failed"
+	// Nothing was left to send, e.g. an embed that unfurls from a link
+	PLAYBACK_ITEM_SKIPPED = "skipped"
+)
+
+const PLAYBACK_RUNS_TO_LIST = 10
+
+// PlaybackRun is the audit log entry for one playback
+type PlaybackRun struct {
+	gorm.Model
+	GuildID string `gorm:"index"`
+	// Discord ID of whoever asked for the playback, empty from the CLI
+	TriggeredBy string
+	TargetID    string `gorm:"index"`
+	// When the replayed session originally started
+	SessionStart         time.Time
+	SourceChannelID      string
+	DestinationChannelID string
+	// Set when the run replays into a channel other than the one each
+	// message came from. DestinationChannelID is then where every message
+	// goes, which is a thread in this channel for a memory lane.
+	ReplayIntoChannelID string
+	// The thread started for a memory lane, deleted again by undo
+	MemoryLaneThreadID string
+	StartedAt          time.Time
+	FinishedAt         time.Time
+	Outcome            string
+	Error              string
+	UndoneAt           time.Time
+	// One of PLAYBACK_DELIVERIES, how the messages were sent
+	Delivery string
+	Items    []PlaybackItem `gorm:"constraint:OnDelete:CASCADE"`
+	// The archived messages sent during this run, not stored
+	Replayed []*Message `gorm:"-"`
+}
+
+// PlaybackItem is a message queued up to be replayed in a run, and once it's
+// sent, the ID of the message we sent
+type PlaybackItem struct {
+	gorm.Model
+	PlaybackRunID uint `gorm:"index"`
+	Position      int
+	MessageID     uint    `gorm:"index"`
+	Message       Message `gorm:"constraint:OnDelete:CASCADE"`
+	Status        string
+	Error         string
+	ChannelID     string
+	SentDiscordID string `gorm:"index"`
+	SentAt        time.Time
+	// Set when the message was sent through one of our webhooks
+	WebhookID string
+}
+
+func StartPlaybackRun(db *gorm.DB, request *PlaybackRequest) (*PlaybackRun, error) {
+	run := &PlaybackRun{
+		GuildID:     request.Guild.DiscordID,
+		TriggeredBy: request.TriggeredBy,
+		TargetID:    request.TargetID,
+		StartedAt:   PlaybackClock.Now(),
+		Outcome:     PLAYBACK_OUTCOME_RUNNING,
+		Delivery:    request.Guild.Delivery(),
+	}
+	result := db.Create(run)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return run, nil
+}
+
+// queue stores the session's messages as pending items to be sent
+func (run *PlaybackRun) queue(db *gorm.DB, messages []*Message) error {
+	run.SessionStart = messages[0].MessageTimestamp
+	run.SourceChannelID = messages[0].Channel.DiscordID
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(run).Updates(PlaybackRun{
+			SessionStart:         run.SessionStart,
+			SourceChannelID:      run.SourceChannelID,
+			DestinationChannelID: run.DestinationChannelID,
+			ReplayIntoChannelID:  run.ReplayIntoChannelID,
+			MemoryLaneThreadID:   run.MemoryLaneThreadID,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		items := make([]PlaybackItem, 0, len(messages))
+		for i, message := range messages {
+			items = append(items, PlaybackItem{
+				PlaybackRunID: run.ID,
+				Position:      i,
+				MessageID:     message.ID,
+				Status:        PLAYBACK_ITEM_PENDING,
+			})
+		}
+		return tx.Create(&items).Error
+	})
+}
+
+// markSent records the item as delivered and the message as replayed together
+func (run *PlaybackRun) markSent(db *gorm.DB, item *PlaybackItem, target *playbackTarget, sent *discordgo.Message) error {
+	channelID := target.ChannelID
+	item.Status = PLAYBACK_ITEM_SENT
+	item.ChannelID = channelID
+	item.SentAt = PlaybackClock.Now()
+	if sent != nil {
+		item.SentDiscordID = sent.ID
+	}
+	if target.Webhook != nil {
+		item.WebhookID = target.Webhook.WebhookID
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		if run.DestinationChannelID == "" {
+			result := tx.Model(run).Update("destination_channel_id", channelID)
+			if result.Error != nil {
+				return result.Error
+			}
+		}
+		result := tx.Omit(clause.Associations).Save(item)
+		if result.Error != nil {
+			return result.Error
+		}
+		return MarkMessageAsReplayed(tx, &item.Message)
+	})
+}
+
+func (run *PlaybackRun) markUnsent(db *gorm.DB, item *PlaybackItem, status string, err error) {
+	item.Status = status
+	if err != nil {
+		item.Error = err.Error()
+	}
+	result := db.Omit(clause.Associations).Save(item)
+	if result.Error != nil {
+		fmt.Println("Unable to update playback item", item.ID, result.Error)
+	}
+}
+
+// deliverPlaybackRun sends the run's pending items in order. Items that can't
+// be sent are marked as failed without stopping the rest, and the last error
+// is returned.
+func deliverPlaybackRun(s Discord, db *gorm.DB, run *PlaybackRun) error {
+	var items []*PlaybackItem
+	db.Preload("Message.Author").Preload("Message.Channel").Preload(
+		"Message.Attachments",
+	).Preload("Message.Embeds").Preload("Message.Stickers").Preload(
+		"Message.ReferencedMessage.Author",
+	).Where(
+		"playback_run_id = ? AND status = ?", run.ID, PLAYBACK_ITEM_PENDING,
+	).Order("position").Find(&items)
+
+	store := OpenBlobStore()
+	destinations := make(map[uint]string)
+	webhooks := newPlaybackWebhooks(s, db)
+	var previous *Message
+	var lastErr error
+	for _, item := range items {
+		message := &item.Message
+		destination := run.DestinationChannelID
+		var err error
+		if run.ReplayIntoChannelID == "" {
+			destination, err = playbackDestination(s, db, destinations, message)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("unable to find somewhere to replay message %d: %w", message.ID, err)
+			run.markUnsent(db, item, PLAYBACK_ITEM_FAILED, lastErr)
+			continue
+		}
+		target := &playbackTarget{ChannelID: destination}
+		if run.Delivery == PLAYBACK_DELIVERY_WEBHOOK {
+			target = webhooks.target(destination)
+		}
+		sent, err := sendPlaybackMessage(s, db, store, target, previous, message)
+		if err == errNothingToReplay {
+			run.markUnsent(db, item, PLAYBACK_ITEM_SKIPPED, nil)
+			continue
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("error sending message %d: %w", message.ID, err)
+			run.markUnsent(db, item, PLAYBACK_ITEM_FAILED, lastErr)
+			continue
+		}
+		err = run.markSent(db, item, target, sent)
+		if err != nil {
+			// It's out there, so carry on rather than send it twice
+			fmt.Println("Unable to record replayed message", message.ID, err)
+		}
+		if run.DestinationChannelID == "" {
+			run.DestinationChannelID = destination
+		}
+		run.Items = append(run.Items, *item)
+		run.Replayed = append(run.Replayed, message)
+		previous = message
+	}
+	return lastErr
+}
+
+// cooldownChannelID is the channel the run's channel cooldown applies to,
+// source when it's replaying messages into their own channels
+func (run *PlaybackRun) cooldownChannelID(source string) string {
+	if run.ReplayIntoChannelID != "" {
+		return run.ReplayIntoChannelID
+	}
+	return source
+}
+
+func (run *PlaybackRun) SentCount(db *gorm.DB) int64 {
+	var sent int64
+	db.Model(&PlaybackItem{}).Where(
+		"playback_run_id = ? AND status = ?", run.ID, PLAYBACK_ITEM_SENT,
+	).Count(&sent)
+	return sent
+}
+
+func (run *PlaybackRun) sentMessageIDs(db *gorm.DB) []uint {
+	var ids []uint
+	db.Model(&PlaybackItem{}).Where(
+		"playback_run_id = ? AND status = ?", run.ID, PLAYBACK_ITEM_SENT,
+	).Pluck("message_id", &ids)
+	return ids
+}
+
+func (run *PlaybackRun) finish(db *gorm.DB, err error) error {
+	run.FinishedAt = PlaybackClock.Now()
+	sent := run.SentCount(db)
+	var failed int64
+	db.Model(&PlaybackItem{}).Where(
+		"playback_run_id = ? AND status = ?", run.ID, PLAYBACK_ITEM_FAILED,
+	).Count(&failed)
+	switch {
+	case err == nil && sent == 0 && failed == 0:
+		run.Outcome = PLAYBACK_OUTCOME_EMPTY
+	case err == nil && failed == 0:
+		run.Outcome = PLAYBACK_OUTCOME_COMPLETED
+	case sent > 0:
+		run.Outcome = PLAYBACK_OUTCOME_PARTIAL
+	default:
+		run.Outcome = PLAYBACK_OUTCOME_FAILED
+		var blocked *PlaybackBlockedError
+		if errors.As(err, &blocked) {
+			run.Outcome = PLAYBACK_OUTCOME_BLOCKED
+		}
+	}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	return db.Model(run).Updates(map[string]interface{}{
+		"finished_at": run.FinishedAt,
+		"outcome":     run.Outcome,
+		"error":       run.Error,
+	}).Error
+}
+
+// GetPlaybackRuns lists the most recent runs in the guild, or everywhere when
+// guildID is empty
+func GetPlaybackRuns(db *gorm.DB, guildID string, limit int) []*PlaybackRun {
+	var runs []*PlaybackRun
+	query := db.Preload("Items")
+	if guildID != "" {
+		query = query.Where("guild_id = ?", guildID)
+	}
+	query.Order("started_at desc").Limit(limit).Find(&runs)
+	return runs
+}
+
+func orderItems(db *gorm.DB) *gorm.DB {
+	return db.Order("position")
+}
+
+func GetPlaybackRun(db *gorm.DB, runID uint) *PlaybackRun {
+	var run PlaybackRun
+	db.Preload("Items", orderItems).Preload("Items.Message").Limit(1).Find(&run, runID)
+	if run.ID == 0 {
+		return nil
+	}
+	return &run
+}
+
+func (run *PlaybackRun) Summary() string {
+	sent := 0
+	for _, item := range run.Items {
+		if item.Status == PLAYBACK_ITEM_SENT {
+			sent++
+		}
+	}
+	line := fmt.Sprintf(
+		"#%d %s %s: %d messages from <@%s>",
+		run.ID,
+		run.StartedAt.Format("2006-01-02 15:04"),
+		run.Outcome,
+		sent,
+		run.TargetID,
+	)
+	if !run.SessionStart.IsZero() {
+		line += " originally sent " + run.SessionStart.Format("2 Jan 2006")
+	}
+	if run.DestinationChannelID != "" {
+		line += " into <#" + run.DestinationChannelID + ">"
+	}
+	if run.TriggeredBy != "" {
+		line += ", asked for by <@" + run.TriggeredBy + ">"
+	}
+	if run.Error != "" {
+		line += " (" + run.Error + ")"
+	}
+	return line
+}
+
+func FormatPlaybackRuns(runs []*PlaybackRun) string {
+	if len(runs) == 0 {
+		return "No playbacks yet"
+	}
+	lines := make([]string, 0, len(runs))
+	for _, run := range runs {
+		lines = append(lines, run.Summary())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// GetLatestPlaybackRun finds the guild's most recent run that sent anything
+// and hasn't been undone
+func GetLatestPlaybackRun(db *gorm.DB, guildID string) *PlaybackRun {
+	var run PlaybackRun
+	db.Preload("Items", orderItems).Preload("Items.Message").Where(
+		"guild_id = ? AND undone_at = ?", guildID, time.Time{},
+	).Where(
+		"EXISTS (SELECT 1 FROM playback_items WHERE playback_items.playback_run_id = playback_runs.id AND status = ?)",
+		PLAYBACK_ITEM_SENT,
+	).Order("started_at desc").Limit(1).Find(&run)
+	if run.ID == 0 {
+		return nil
+	}
+	return &run
+}
+
+func isNotFound(err error) bool {
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound
+}
+
+// deleteSentItem deletes a replayed message, through its webhook if it was sent
+// with one since that doesn't need Manage Messages
+func deleteSentItem(s Discord, db *gorm.DB, item *PlaybackItem) error {
+	if item.WebhookID != "" {
+		if webhook := getPlaybackWebhookByID(db, item.WebhookID); webhook != nil {
+			err := s.WebhookMessageDelete(webhook.WebhookID, webhook.Token, item.SentDiscordID)
+			if !isNotFound(err) {
+				return err
+			}
+		}
+	}
+	return s.ChannelMessageDelete(item.ChannelID, item.SentDiscordID)
+}
+
+// UndoPlaybackRun deletes the messages the run sent, and its memory lane
+// thread, and makes the archived messages eligible for playback again.
+// Cooldowns and quotas the run used up are left alone. Returns how many
+// messages were deleted.
+func UndoPlaybackRun(s Discord, db *gorm.DB, run *PlaybackRun) (int, error) {
+	if !run.UndoneAt.IsZero() {
+		return 0, fmt.Errorf("playback %d was already undone", run.ID)
+	}
+	deleted := 0
+	for _, item := range run.Items {
+		if item.Status != PLAYBACK_ITEM_SENT {
+			continue
+		}
+		if item.SentDiscordID != "" {
+			err := deleteSentItem(s, db, &item)
+			// Someone beat us to it
+			if err != nil && !isNotFound(err) {
+				return deleted, err
+			}
+			deleted++
+		}
+		result := db.Model(&Message{}).Where("id = ?", item.MessageID).Update("replayed_at", time.Time{})
+		if result.Error != nil {
+			return deleted, result.Error
+		}
+	}
+	err := RefreshPlaybackSessionsReplayed(db, run.sentMessageIDs(db))
+	if err != nil {
+		return deleted, err
+	}
+	if run.MemoryLaneThreadID != "" {
+		_, err = s.ChannelDelete(run.MemoryLaneThreadID)
+		if err != nil && !isNotFound(err) {
+			return deleted, err
+		}
+	}
+	run.UndoneAt = PlaybackClock.Now()
+	run.Outcome = PLAYBACK_OUTCOME_UNDONE
+	return deleted, db.Model(run).Updates(map[string]interface{}{
+		"undone_at": run.UndoneAt,
+		"outcome":   run.Outcome,
+	}).Error
+}
@@ -0,0 +1,391 @@
+package ronnyd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+type ScrapeDirection string
+
+const (
+	SCRAPE_BACKWARD ScrapeDirection = "backward"
+	SCRAPE_FORWARD  ScrapeDirection = "forward"
+)
+
+const (
+	SCRAPE_STATUS_RUNNING       = "running"
+	SCRAPE_STATUS_DONE          = "done"
+	SCRAPE_STATUS_REACHED_START = "reached_start"
+	SCRAPE_STATUS_CAUGHT_UP     = "caught_up"
+	SCRAPE_STATUS_FAILED        = "failed"
+)
+
+// Discord won't give us more than this many messages per request
+const SCRAPE_PAGE_SIZE = 100
+
+// ScrapeState tracks how much of a channel's history we have fetched. The
+// range between OldestDiscordID and NewestDiscordID is always contiguous, so
+// any scrape that lands inside it can skip straight to one of its ends.
+type ScrapeState struct {
+	gorm.Model
+	ChannelID           uint `gorm:"uniqueIndex"`
+	Channel             Channel
+	OldestDiscordID     string
+	NewestDiscordID     string
+	ReachedChannelStart bool
+	LastRunDirection    ScrapeDirection
+	LastRunStatus       string
+	LastRunError        string
+	LastRunStartedAt    time.Time
+	LastRunFinishedAt   time.Time
+	LastRunMessages     int
+	LastRunCursor       string
+	TotalMessages       int
+	TotalRuns           int
+}
+
+func GetScrapeState(db *gorm.DB, channelID uint) (*ScrapeState, error) {
+	var state ScrapeState
+	result := db.Where(ScrapeState{ChannelID: channelID}).FirstOrCreate(&state)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &state, nil
+}
+
+func (state *ScrapeState) Summary() string {
+	summary := fmt.Sprintf(
+		"Indexed %d messages (%d total)",
+		state.LastRunMessages,
+		state.TotalMessages,
+	)
+	switch state.LastRunStatus {
+	case SCRAPE_STATUS_REACHED_START:
+		summary += ", reached channel start"
+	case SCRAPE_STATUS_CAUGHT_UP:
+		summary += ", caught up to latest message"
+	case SCRAPE_STATUS_FAILED:
+		summary += ", failed: " + state.LastRunError
+	}
+	return summary
+}
+
+// Snowflakes are strictly increasing with time, but only when compared as
+// numbers, so string comparison isn't good enough
+func snowflakeBefore(a string, b string) bool {
+	aID, errA := strconv.ParseUint(a, 10, 64)
+	bID, errB := strconv.ParseUint(b, 10, 64)
+	if errA != nil || errB != nil {
+		return len(a) < len(b) || (len(a) == len(b) && a < b)
+	}
+	return aID < bID
+}
+
+func (state *ScrapeState) contains(discordID string) bool {
+	if state.OldestDiscordID == "" {
+		return false
+	}
+	return !snowflakeBefore(discordID, state.OldestDiscordID) && !snowflakeBefore(state.NewestDiscordID, discordID)
+}
+
+func (state *ScrapeState) extendRange(oldest string, newest string) {
+	if oldest != "" && (state.OldestDiscordID == "" || snowflakeBefore(oldest, state.OldestDiscordID)) {
+		state.OldestDiscordID = oldest
+	}
+	if newest != "" && (state.NewestDiscordID == "" || snowflakeBefore(state.NewestDiscordID, newest)) {
+		state.NewestDiscordID = newest
+	}
+}
+
+func (state *ScrapeState) finishRun(db *gorm.DB, status string, err error) error {
+	state.LastRunStatus = status
+	state.LastRunFinishedAt = time.Now()
+	if err != nil {
+		state.LastRunError = err.Error()
+	}
+	result := db.Save(state)
+	if err != nil {
+		return err
+	}
+	return result.Error
+}
+
+func ScrapeChannelForMessages(s Discord, channelID string, maxMessages int, anchorMessageId string) (*ScrapeState, error) {
+	db := ConnectToDB()
+	return ScrapeChannel(s, db, channelID, maxMessages, anchorMessageId, SCRAPE_BACKWARD)
+}
+
+// ErrNothingIndexed is when there's no scrape to resume in a channel
+var ErrNothingIndexed = errors.New("nothing has been indexed yet")
+
+// ResumeChannelScrape picks up a backward scrape from the oldest message we
+// have fetched for the channel
+func ResumeChannelScrape(s Discord, db *gorm.DB, channelID string, maxMessages int) (*ScrapeState, error) {
+	channel := IsChannelIndexed(db, channelID)
+	if channel == 0 {
+		return nil, fmt.Errorf("channel %s is not indexed", channelID)
+	}
+	state, err := GetScrapeState(db, channel)
+	if err != nil {
+		return nil, err
+	}
+	if state.ReachedChannelStart {
+		state.LastRunMessages = 0
+		state.LastRunDirection = SCRAPE_BACKWARD
+		return state, state.finishRun(db, SCRAPE_STATUS_REACHED_START, nil)
+	}
+	anchor := state.OldestDiscordID
+	if anchor == "" {
+		// Channels indexed before we tracked scrape state
+		anchor = GetHighwaterMessage(db, channelID).DiscordID
+	}
+	if anchor == "" {
+		return nil, fmt.Errorf("%w in channel %s", ErrNothingIndexed, channelID)
+	}
+	return ScrapeChannel(s, db, channelID, maxMessages, anchor, SCRAPE_BACKWARD)
+}
+
+// ScrapeChannel fetches up to maxMessages from the channel starting at the
+// anchor and walking in the given direction. Progress is checkpointed into the
+// channel's ScrapeState after every page, so an interrupted scrape can be
+// resumed, and pages inside the already fetched range are skipped.
+func ScrapeChannel(s Discord, db *gorm.DB, channelID string, maxMessages int, anchorMessageId string, direction ScrapeDirection) (*ScrapeState, error) {
+	channel := IsChannelIndexed(db, channelID)
+	if channel == 0 {
+		return nil, fmt.Errorf("channel %s is not indexed", channelID)
+	}
+	state, err := GetScrapeState(db, channel)
+	if err != nil {
+		return nil, err
+	}
+	if state.LastRunStatus == SCRAPE_STATUS_RUNNING {
+		log.Default().Println("Previous scrape was interrupted", channelID, state.LastRunStartedAt)
+	}
+	state.LastRunDirection = direction
+	state.LastRunStatus = SCRAPE_STATUS_RUNNING
+	state.LastRunError = ""
+	state.LastRunStartedAt = time.Now()
+	state.LastRunMessages = 0
+	state.TotalRuns++
+	result := db.Save(state)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+
+	anchor := anchorMessageId
+	// Only fold what we fetch into the saved range once we know it touches it,
+	// otherwise we'd be claiming to have fetched a gap we skipped over
+	connected := state.OldestDiscordID == "" || state.contains(anchor)
+	status := SCRAPE_STATUS_DONE
+	for state.LastRunMessages < maxMessages {
+		if direction == SCRAPE_BACKWARD && state.contains(anchor) {
+			if state.ReachedChannelStart {
+				status = SCRAPE_STATUS_REACHED_START
+				break
+			}
+			anchor = state.OldestDiscordID
+		} else if direction == SCRAPE_FORWARD && state.contains(anchor) {
+			anchor = state.NewestDiscordID
+		}
+
+		limit := int(math.Min(float64(maxMessages-state.LastRunMessages), SCRAPE_PAGE_SIZE))
+		var messages []*discordgo.Message
+		if direction == SCRAPE_BACKWARD {
+			messages, err = s.ChannelMessages(channelID, limit, anchor, "", "")
+		} else {
+			messages, err = s.ChannelMessages(channelID, limit, "", anchor, "")
+		}
+		if err != nil {
+			return state, state.finishRun(db, SCRAPE_STATUS_FAILED, err)
+		}
+
+		sort.Slice(messages, func(i, j int) bool {
+			if direction == SCRAPE_BACKWARD {
+				return snowflakeBefore(messages[j].ID, messages[i].ID)
+			}
+			return snowflakeBefore(messages[i].ID, messages[j].ID)
+		})
+		var pageOldest, pageNewest string
+		for _, message := range messages {
+			// Webhook messages, like our own replays, aren't stored, but they
+			// still move the scrape along
+			if message.WebhookID == "" {
+				persistedMessage, created, err := PersistNewMessageToDb(db, message)
+				if err != nil {
+					return state, state.finishRun(db, SCRAPE_STATUS_FAILED, err)
+				}
+				if persistedMessage == nil {
+					return state, state.finishRun(db, SCRAPE_STATUS_FAILED, errors.New("channel stopped being indexed"))
+				}
+				if created {
+					// Rescraping returns messages we already have
+					state.TotalMessages++
+				}
+			}
+			state.LastRunMessages++
+			anchor = message.ID
+			if state.contains(message.ID) {
+				connected = true
+			}
+			if pageOldest == "" || snowflakeBefore(message.ID, pageOldest) {
+				pageOldest = message.ID
+			}
+			if pageNewest == "" || snowflakeBefore(pageNewest, message.ID) {
+				pageNewest = message.ID
+			}
+		}
+		if connected {
+			state.extendRange(pageOldest, pageNewest)
+		}
+		state.LastRunCursor = anchor
+
+		if len(messages) < limit {
+			if direction == SCRAPE_BACKWARD {
+				state.ReachedChannelStart = state.ReachedChannelStart || connected
+				status = SCRAPE_STATUS_REACHED_START
+			} else {
+				status = SCRAPE_STATUS_CAUGHT_UP
+			}
+			break
+		}
+		result = db.Save(state)
+		if result.Error != nil {
+			return state, result.Error
+		}
+		log.Default().Println("Scraped page", channelID, direction, state.LastRunMessages, "/", maxMessages)
+	}
+	return state, state.finishRun(db, status, nil)
+}
+
+// How many messages to fetch per channel between progress checkpoints while
+// catching up
+const CATCH_UP_BATCH_SIZE = 1000
+
+var catchUpMutex sync.Mutex
+
+type CatchUpResult struct {
+	ChannelID   string
+	NewMessages int
+	Err         error
+}
+
+func GetNewestMessage(db *gorm.DB, channelID uint) *Message {
+	var newestMessage Message
+	db.Order("message_timestamp desc").Limit(1).Find(&newestMessage, "channel_id = ?", channelID)
+	return &newestMessage
+}
+
+// CatchUpChannel scrapes forward from the newest message we have stored for
+// the channel until there is nothing left to fetch
+func CatchUpChannel(s Discord, db *gorm.DB, channel *Channel) (int, error) {
+	newestMessage := GetNewestMessage(db, channel.ID)
+	anchor := newestMessage.DiscordID
+	state, err := GetScrapeState(db, channel.ID)
+	if err != nil {
+		return 0, err
+	}
+	if state.NewestDiscordID != "" && (anchor == "" || snowflakeBefore(anchor, state.NewestDiscordID)) {
+		anchor = state.NewestDiscordID
+	}
+	if anchor == "" {
+		// Nothing to catch up from, the channel has never been scraped
+		return 0, nil
+	}
+
+	newMessages := 0
+	for {
+		totalBefore := state.TotalMessages
+		state, err = ScrapeChannel(s, db, channel.DiscordID, CATCH_UP_BATCH_SIZE, anchor, SCRAPE_FORWARD)
+		if state != nil {
+			// Only messages we didn't have yet, which is what the total counts
+			newMessages += state.TotalMessages - totalBefore
+		}
+		if err != nil {
+			return newMessages, err
+		}
+		log.Default().Println("Catching up channel", channel.DiscordID, newMessages, "new messages so far")
+		if state.LastRunStatus == SCRAPE_STATUS_CAUGHT_UP || state.LastRunCursor == anchor {
+			return newMessages, nil
+		}
+		anchor = state.LastRunCursor
+	}
+}
+
+// CatchUpIndexedChannels fetches everything posted in indexed channels while
+// the bot wasn't listening. Only one catch up runs at a time, overlapping
+// requests are dropped.
+func CatchUpIndexedChannels(s Discord, db *gorm.DB) []CatchUpResult {
+	if !catchUpMutex.TryLock() {
+		log.Default().Println("Catch up already in progress")
+		return nil
+	}
+	defer catchUpMutex.Unlock()
+
+	var channels []*Channel
+	db.Order("id").Find(&channels)
+	results := make([]CatchUpResult, 0, len(channels))
+	for _, channel := range channels {
+		newMessages, err := CatchUpChannel(s, db, channel)
+		if err != nil {
+			log.Default().Println("Error catching up channel", channel.DiscordID, err)
+		}
+		results = append(results, CatchUpResult{
+			ChannelID:   channel.DiscordID,
+			NewMessages: newMessages,
+			Err:         err,
+		})
+	}
+	return results
+}
+
+func CatchUpSummary(results []CatchUpResult) string {
+	var lines []string
+	total := 0
+	for _, result := range results {
+		total += result.NewMessages
+		if result.Err != nil {
+			lines = append(lines, fmt.Sprintf("<#%s>: %d new messages, failed: %s", result.ChannelID, result.NewMessages, result.Err))
+		} else if result.NewMessages > 0 {
+			lines = append(lines, fmt.Sprintf("<#%s>: %d new messages", result.ChannelID, result.NewMessages))
+		}
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	header := fmt.Sprintf("Caught up %d channels, %d messages missed while offline", len(results), total)
+	return header + "\n" + strings.Join(lines, "\n")
+}
+
+// NotifyAdmin sends a DM to the configured admin
+func NotifyAdmin(s Discord, content string) error {
+	LoadConfig()
+	channel, err := s.UserChannelCreate(os.Getenv("ADMIN_DISCORD_ID"))
+	if err != nil {
+		return err
+	}
+	_, err = s.ChannelMessageSend(channel.ID, content)
+	return err
+}
+
+func catchUpAndNotify(s Discord) {
+	db := ConnectToDB()
+	summary := CatchUpSummary(CatchUpIndexedChannels(s, db))
+	if summary == "" {
+		return
+	}
+	err := NotifyAdmin(s, summary)
+	if err != nil {
+		log.Default().Println("Error notifying admin", err)
+	}
+}
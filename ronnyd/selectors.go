@@ -0,0 +1,187 @@
+package ronnyd
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	SESSION_SELECTION_NEWEST          = "newest"
+	SESSION_SELECTION_OLDEST          = "oldest"
+	SESSION_SELECTION_RANDOM          = "random"
+	SESSION_SELECTION_LONGEST         = "longest"
+	SESSION_SELECTION_WEIGHTED_LENGTH = "weighted_length"
+	SESSION_SELECTION_REACTIONS       = "reactions"
+	SESSION_SELECTION_ON_THIS_DAY     = "on_this_day"
+)
+
+var SESSION_SELECTIONS = []string{
+	SESSION_SELECTION_NEWEST,
+	SESSION_SELECTION_OLDEST,
+	SESSION_SELECTION_RANDOM,
+	SESSION_SELECTION_LONGEST,
+	SESSION_SELECTION_WEIGHTED_LENGTH,
+	SESSION_SELECTION_REACTIONS,
+	SESSION_SELECTION_ON_THIS_DAY,
+}
+
+// SessionSelector picks which of an author's sessions, oldest first, gets
+// replayed. nil means none of them should be.
+type SessionSelector interface {
+	Select(sessions [][]*Message) []*Message
+}
+
+// sortSessions orders the sessions from GroupMessagesForPlayback oldest first
+func sortSessions(messageMap map[time.Time][]*Message) [][]*Message {
+	keys := make([]time.Time, 0, len(messageMap))
+	for k := range messageMap {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Before(keys[j])
+	})
+	sessions := make([][]*Message, 0, len(keys))
+	for _, key := range keys {
+		sessions = append(sessions, messageMap[key])
+	}
+	return sessions
+}
+
+// SelectSession picks one of the sessions from GroupMessagesForPlayback
+func SelectSession(messageMap map[time.Time][]*Message, selector SessionSelector) []*Message {
+	sessions := sortSessions(messageMap)
+	if len(sessions) == 0 {
+		return nil
+	}
+	return selector.Select(sessions)
+}
+
+// NewestSelector is what playback has always done, the latest session
+type NewestSelector struct{}
+
+func (selector *NewestSelector) Select(sessions [][]*Message) []*Message {
+	return sessions[len(sessions)-1]
+}
+
+type OldestSelector struct{}
+
+func (selector *OldestSelector) Select(sessions [][]*Message) []*Message {
+	return sessions[0]
+}
+
+// RandomSelector picks any session with equal chance. Give it a seeded Rand
+// to get the same pick every time.
+type RandomSelector struct {
+	Rand *rand.Rand
+}
+
+func (selector *RandomSelector) Select(sessions [][]*Message) []*Message {
+	return sessions[selector.Rand.Intn(len(sessions))]
+}
+
+// LongestSelector picks the session with the most messages, the latest one
+// if there's a tie
+type LongestSelector struct{}
+
+func (selector *LongestSelector) Select(sessions [][]*Message) []*Message {
+	longest := sessions[0]
+	for _, session := range sessions[1:] {
+		if len(session) >= len(longest) {
+			longest = session
+		}
+	}
+	return longest
+}
+
+// WeightedSelector picks sessions at random, in proportion to Weight
+type WeightedSelector struct {
+	Rand   *rand.Rand
+	Weight func(session []*Message) int
+}
+
+func (selector *WeightedSelector) Select(sessions [][]*Message) []*Message {
+	weights := make([]int, 0, len(sessions))
+	total := 0
+	for _, session := range sessions {
+		weight := selector.Weight(session)
+		if weight < 0 {
+			weight = 0
+		}
+		weights = append(weights, weight)
+		total += weight
+	}
+	if total == 0 {
+		return nil
+	}
+	pick := selector.Rand.Intn(total)
+	for i, weight := range weights {
+		if pick < weight {
+			return sessions[i]
+		}
+		pick -= weight
+	}
+	return nil
+}
+
+func sessionLength(session []*Message) int {
+	return len(session)
+}
+
+// Sessions nobody reacted to still get a chance, just a smaller one
+func sessionReactions(session []*Message) int {
+	weight := 1
+	for _, message := range session {
+		weight += message.ReactionCount
+	}
+	return weight
+}
+
+// OnThisDaySelector picks the most recent session that started on today's
+// date in an earlier year, and nothing if there isn't one. Now is the current
+// time when unset.
+type OnThisDaySelector struct {
+	Now time.Time
+}
+
+func (selector *OnThisDaySelector) Select(sessions [][]*Message) []*Message {
+	now := selector.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	now = now.UTC()
+	for i := len(sessions) - 1; i >= 0; i-- {
+		start := sessions[i][0].MessageTimestamp.UTC()
+		if start.Year() < now.Year() && start.Month() == now.Month() && start.Day() == now.Day() {
+			return sessions[i]
+		}
+	}
+	return nil
+}
+
+// NewSessionSelector builds the named selection. Random selections are seeded
+// with seed, or the current time when it's 0.
+func NewSessionSelector(name string, seed int64) (SessionSelector, error) {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	random := rand.New(rand.NewSource(seed))
+	switch name {
+	case SESSION_SELECTION_NEWEST, "":
+		return &NewestSelector{}, nil
+	case SESSION_SELECTION_OLDEST:
+		return &OldestSelector{}, nil
+	case SESSION_SELECTION_RANDOM:
+		return &RandomSelector{Rand: random}, nil
+	case SESSION_SELECTION_LONGEST:
+		return &LongestSelector{}, nil
+	case SESSION_SELECTION_WEIGHTED_LENGTH:
+		return &WeightedSelector{Rand: random, Weight: sessionLength}, nil
+	case SESSION_SELECTION_REACTIONS:
+		return &WeightedSelector{Rand: random, Weight: sessionReactions}, nil
+	case SESSION_SELECTION_ON_THIS_DAY:
+		return &OnThisDaySelector{}, nil
+	}
+	return nil, fmt.Errorf("unknown session selection %q", name)
+}
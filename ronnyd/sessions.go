@@ -0,0 +1,227 @@
+package ronnyd
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	SESSION_GROUPING_DEFAULT      = "default"
+	SESSION_GROUPING_TIME_GAP     = "time_gap"
+	SESSION_GROUPING_MAX_LENGTH   = "max_length"
+	SESSION_GROUPING_REPLY_CHAIN  = "reply_chain"
+	SESSION_GROUPING_SAME_CHANNEL = "same_channel"
+)
+
+var SESSION_GROUPINGS = []string{
+	SESSION_GROUPING_DEFAULT,
+	SESSION_GROUPING_TIME_GAP,
+	SESSION_GROUPING_MAX_LENGTH,
+	SESSION_GROUPING_REPLY_CHAIN,
+	SESSION_GROUPING_SAME_CHANNEL,
+}
+
+const DEFAULT_MAX_SESSION_LENGTH = 30 * time.Minute
+
+// SessionGrouper splits an author's messages, oldest first, into the sessions
+// we pick from for playback
+type SessionGrouper interface {
+	Group(db *gorm.DB, messages []*Message) [][]*Message
+}
+
+// splitSessions starts a new session whenever newSession says the message
+// doesn't belong with the current one
+func splitSessions(messages []*Message, newSession func(session []*Message, message *Message) bool) [][]*Message {
+	var sessions [][]*Message
+	for _, message := range messages {
+		if len(sessions) == 0 || newSession(sessions[len(sessions)-1], message) {
+			sessions = append(sessions, make([]*Message, 0, 1))
+		}
+		sessions[len(sessions)-1] = append(sessions[len(sessions)-1], message)
+	}
+	return sessions
+}
+
+func sinceLast(session []*Message, message *Message) time.Duration {
+	return message.MessageTimestamp.Sub(session[len(session)-1].MessageTimestamp)
+}
+
+func sinceStart(session []*Message, message *Message) time.Duration {
+	return message.MessageTimestamp.Sub(session[0].MessageTimestamp)
+}
+
+// DefaultGrouper is how sessions have always been grouped: they last at most
+// Gap from their first message, and end when someone else speaks in the
+// channel
+type DefaultGrouper struct {
+	Gap time.Duration
+}
+
+// defaultSessionsQuery numbers the author's sessions in one query. A message
+// starts a new session when it's more than Gap after the session's first
+// message, or someone else has spoken in its channel since then. Both depend
+// on where the current session started, so the messages are walked in order
+// rather than compared with a plain lag.
+const defaultSessionsQuery = `
+WITH RECURSIVE timeline AS (
+	SELECT id, author_id, message_timestamp, MAX(CASE WHEN author_id != @author THEN message_timestamp END) OVER (
+		PARTITION BY channel_id
+		ORDER BY message_timestamp
+		RANGE BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW EXCLUDE GROUP
+	) AS last_interruption
+	FROM messages
+	WHERE deleted_at IS NULL AND channel_id IN @channels
+), candidates AS (
+	-- A message starts a new session if the current one started before its cutoff
+	SELECT
+		ARRAY_AGG(timeline.id ORDER BY candidate.n) AS ids,
+		ARRAY_AGG(timeline.message_timestamp ORDER BY candidate.n) AS stamps,
+		ARRAY_AGG(GREATEST(
+			timeline.message_timestamp - @gap * INTERVAL '1 microsecond',
+			timeline.last_interruption
+		) ORDER BY candidate.n) AS cutoffs
+	FROM timeline
+	JOIN UNNEST(CAST(@ids AS bigint[])) WITH ORDINALITY AS candidate(id, n) ON candidate.id = timeline.id
+	WHERE timeline.author_id = @author
+), walk AS (
+	SELECT 1 AS n, stamps[1] AS session_start, true AS starts_session
+	FROM candidates
+	WHERE ids IS NOT NULL
+	UNION ALL
+	SELECT walk.n + 1,
+		CASE WHEN cutoffs[walk.n + 1] > walk.session_start THEN stamps[walk.n + 1] ELSE walk.session_start END,
+		cutoffs[walk.n + 1] > walk.session_start
+	FROM walk, candidates
+	WHERE walk.n < CARDINALITY(candidates.ids)
+)
+SELECT candidates.ids[walk.n] AS id,
+	SUM(CASE WHEN walk.starts_session THEN 1 ELSE 0 END) OVER (ORDER BY walk.n) AS session_id
+FROM walk, candidates`
+
+type defaultSession struct {
+	ID        uint
+	SessionID int
+}
+
+func (grouper *DefaultGrouper) Group(db *gorm.DB, messages []*Message) [][]*Message {
+	if len(messages) == 0 {
+		return nil
+	}
+	channels := make([]uint, 0)
+	seen := make(map[uint]bool)
+	// Passed as one array so there's no limit on how many messages we group
+	ids := make([]string, 0, len(messages))
+	for _, message := range messages {
+		if !seen[message.ChannelID] {
+			seen[message.ChannelID] = true
+			channels = append(channels, message.ChannelID)
+		}
+		ids = append(ids, strconv.FormatUint(uint64(message.ID), 10))
+	}
+	var rows []defaultSession
+	result := db.Raw(defaultSessionsQuery, map[string]interface{}{
+		"author":   messages[0].AuthorID,
+		"channels": channels,
+		"ids":      "{" + strings.Join(ids, ",") + "}",
+		"gap":      grouper.Gap.Microseconds(),
+	}).Scan(&rows)
+	if result.Error != nil {
+		log.Default().Println("Error grouping sessions", result.Error)
+		return nil
+	}
+
+	sessionOf := make(map[uint]int, len(rows))
+	for _, row := range rows {
+		sessionOf[row.ID] = row.SessionID
+	}
+	var sessions [][]*Message
+	for _, message := range messages {
+		sessionID, ok := sessionOf[message.ID]
+		if !ok {
+			continue
+		}
+		// Sessions are numbered from 1 in the same order as the messages
+		for len(sessions) < sessionID {
+			sessions = append(sessions, nil)
+		}
+		sessions[sessionID-1] = append(sessions[sessionID-1], message)
+	}
+	return sessions
+}
+
+// TimeGapGrouper only ends a session after Gap without a message
+type TimeGapGrouper struct {
+	Gap time.Duration
+}
+
+func (grouper *TimeGapGrouper) Group(db *gorm.DB, messages []*Message) [][]*Message {
+	return splitSessions(messages, func(session []*Message, message *Message) bool {
+		return sinceLast(session, message) > grouper.Gap
+	})
+}
+
+// MaxLengthGrouper is the time gap grouping, but cuts off sessions that go on
+// for longer than MaxLength
+type MaxLengthGrouper struct {
+	Gap       time.Duration
+	MaxLength time.Duration
+}
+
+func (grouper *MaxLengthGrouper) Group(db *gorm.DB, messages []*Message) [][]*Message {
+	return splitSessions(messages, func(session []*Message, message *Message) bool {
+		return sinceLast(session, message) > grouper.Gap || sinceStart(session, message) > grouper.MaxLength
+	})
+}
+
+// ReplyChainGrouper treats someone else speaking as the end of a session,
+// unless the author replies, since then they're still in the conversation
+type ReplyChainGrouper struct {
+	Gap time.Duration
+}
+
+func (grouper *ReplyChainGrouper) Group(db *gorm.DB, messages []*Message) [][]*Message {
+	return splitSessions(messages, func(session []*Message, message *Message) bool {
+		if sinceLast(session, message) > grouper.Gap {
+			return true
+		}
+		if message.ReferencedMessageID != nil || message.ReferencedDiscordID != "" {
+			return false
+		}
+		previous := session[len(session)-1]
+		return thereExistsMessageFromSomeoneElseInBetween(db, previous.MessageTimestamp, message.MessageTimestamp, message.AuthorID, message.ChannelID)
+	})
+}
+
+// SameChannelGrouper ends a session when the author moves to another channel
+type SameChannelGrouper struct {
+	Gap time.Duration
+}
+
+func (grouper *SameChannelGrouper) Group(db *gorm.DB, messages []*Message) [][]*Message {
+	return splitSessions(messages, func(session []*Message, message *Message) bool {
+		return sinceLast(session, message) > grouper.Gap || message.ChannelID != session[0].ChannelID
+	})
+}
+
+// NewSessionGrouper builds the named grouping using the guild's session gap
+// and max length
+func NewSessionGrouper(name string, guild *Guild) (SessionGrouper, error) {
+	switch name {
+	case SESSION_GROUPING_DEFAULT, "":
+		return &DefaultGrouper{Gap: guild.Gap()}, nil
+	case SESSION_GROUPING_TIME_GAP:
+		return &TimeGapGrouper{Gap: guild.Gap()}, nil
+	case SESSION_GROUPING_MAX_LENGTH:
+		return &MaxLengthGrouper{Gap: guild.Gap(), MaxLength: guild.MaxLength()}, nil
+	case SESSION_GROUPING_REPLY_CHAIN:
+		return &ReplyChainGrouper{Gap: guild.Gap()}, nil
+	case SESSION_GROUPING_SAME_CHANNEL:
+		return &SameChannelGrouper{Gap: guild.Gap()}, nil
+	}
+	return nil, fmt.Errorf("unknown session grouping %q", name)
+}
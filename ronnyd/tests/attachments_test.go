@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestPersistAttachmentsAndStickers(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var indexedChannel ronnyd.Channel
+	db.First(&indexedChannel)
+	var adminAuthor ronnyd.Author
+	db.First(&adminAuthor, "discord_id = ?", os.Getenv("ADMIN_DISCORD_ID"))
+
+	discordMessage1 := &discordgo.Message{
+		ChannelID: fmt.Sprint(indexedChannel.DiscordID),
+		GuildID:   fmt.Sprint(indexedChannel.GuildId),
+		Timestamp: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		ID:        "2345",
+		Author: &discordgo.User{
+			ID:            adminAuthor.DiscordID,
+			Username:      adminAuthor.Name,
+			Discriminator: adminAuthor.Discriminator,
+		},
+		Attachments: []*discordgo.MessageAttachment{{
+			ID:          "2346",
+			URL:         "https://cdn.discordapp.com/attachments/1/2346/cat.png",
+			Filename:    "cat.png",
+			ContentType: "image/png",
+			Size:        1024,
+			Width:       64,
+			Height:      48,
+		}},
+		StickerItems: []*discordgo.StickerItem{{
+			ID:         "2347",
+			Name:       "wave",
+			FormatType: discordgo.StickerFormatTypePNG,
+		}},
+	}
+	_, err := ronnyd.PersistMessageToDb(db, discordMessage1)
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(&ronnyd.Message{}, "discord_id = ?", discordMessage1.ID)
+
+	var message1 ronnyd.Message
+	db.Preload("Attachments").Preload("Embeds").Preload("Stickers").First(&message1, "discord_id = ?", discordMessage1.ID)
+	assert.Len(t, message1.Attachments, 1)
+	assert.Equal(t, "image/png", message1.Attachments[0].ContentType)
+	assert.Equal(t, 64, message1.Attachments[0].Width)
+	assert.Len(t, message1.Stickers, 1)
+	assert.Equal(
+		t,
+		"https://cdn.discordapp.com/attachments/1/2346/cat.png\nhttps://media.discordapp.net/stickers/2347.png",
+		ronnyd.PlaybackContent(&message1),
+	)
+
+	// Discord fills in embeds for links after the fact
+	err = ronnyd.UpdateMessageEmbeds(db, &discordgo.Message{
+		ID: discordMessage1.ID,
+		Embeds: []*discordgo.MessageEmbed{{
+			Type:  discordgo.EmbedTypeRich,
+			Title: "A cat",
+			URL:   "https://example.com/cat",
+		}},
+	})
+	assert.Nil(t, err)
+	db.Preload("Attachments").Preload("Embeds").Preload("Stickers").First(&message1, "discord_id = ?", discordMessage1.ID)
+	assert.Len(t, message1.Attachments, 1)
+	assert.Len(t, message1.Embeds, 1)
+	assert.Contains(t, ronnyd.PlaybackContent(&message1), "A cat https://example.com/cat")
+}
@@ -0,0 +1,55 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestAuthorProfileHistory(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	user := &discordgo.User{ID: "7890", Username: "ronny", Discriminator: "0001", Avatar: "a1"}
+
+	author, err := ronnyd.PersistAuthorProfile(db, user, nil, "")
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(&ronnyd.Author{}, author.ID)
+	defer db.Unscoped().Delete(&ronnyd.AuthorHistory{}, "author_id = ?", author.ID)
+
+	// Nothing changed, so nothing new to record
+	_, err = ronnyd.PersistAuthorProfile(db, user, nil, "")
+	assert.Nil(t, err)
+	assert.Len(t, ronnyd.GetAuthorHistory(db, author.ID), 1)
+
+	user.Username = "ronald"
+	user.Avatar = "a2"
+	_, err = ronnyd.PersistAuthorProfile(db, user, &discordgo.Member{Nick: "the destroyer"}, "1")
+	assert.Nil(t, err)
+	assert.Nil(t, ronnyd.UpdateKnownAuthorProfile(db, user, &discordgo.Member{Nick: "ron"}, "2"))
+	user.GlobalName = "Ronald D"
+	assert.Nil(t, ronnyd.UpdateKnownAuthorProfile(db, user, nil, ""))
+	// Unknown users aren't tracked
+	assert.Nil(t, ronnyd.UpdateKnownAuthorProfile(db, &discordgo.User{ID: "7891", Username: "stranger"}, nil, ""))
+
+	var stored ronnyd.Author
+	db.First(&stored, author.ID)
+	assert.Equal(t, "ronald", stored.Name)
+	assert.Equal(t, "a2", stored.Avatar)
+	assert.Equal(t, "Ronald D", stored.GlobalName)
+	assert.Equal(t, "ron", stored.Nickname)
+	assert.Equal(t, "the destroyer", ronnyd.GetAuthorNickname(db, author.ID, "1"))
+	assert.Equal(t, "ron", ronnyd.GetAuthorNickname(db, author.ID, "2"))
+	// Without a nickname in the guild they go by their display name
+	assert.Equal(t, "Ronald D", ronnyd.GetAuthorNickname(db, author.ID, "3"))
+
+	history := ronnyd.GetAuthorHistory(db, author.ID)
+	assert.Len(t, history, 4)
+	assert.Equal(t, "ronny", history[0].Name)
+	assert.Empty(t, history[0].GlobalName)
+	assert.Equal(t, "Ronald D", history[3].GlobalName)
+
+	var strangers int64
+	db.Model(&ronnyd.Author{}).Where("discord_id = ?", "7891").Count(&strangers)
+	assert.Zero(t, strangers)
+}
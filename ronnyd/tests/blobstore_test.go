@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestArchivedAttachmentsAreDeduplicatedAndReuploaded(t *testing.T) {
+	useFakeClock(t)
+	t.Setenv("BLOB_STORE_PATH", t.TempDir())
+	// Stand in for discord's CDN
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not really a png"))
+	}))
+	defer cdn.Close()
+
+	db := ronnyd.ConnectToDB()
+	var indexedChannel ronnyd.Channel
+	db.First(&indexedChannel)
+	var adminAuthor ronnyd.Author
+	db.First(&adminAuthor, "discord_id = ?", os.Getenv("ADMIN_DISCORD_ID"))
+
+	var messages []*ronnyd.Message
+	var discordMessages []*discordgo.Message
+	for i, messageID := range []string{"3456", "3457"} {
+		discordMessage := &discordgo.Message{
+			ChannelID: fmt.Sprint(indexedChannel.DiscordID),
+			GuildID:   fmt.Sprint(indexedChannel.GuildId),
+			Timestamp: time.Date(2021, 1, 1, 0, i, 0, 0, time.UTC),
+			ID:        messageID,
+			Author: &discordgo.User{
+				ID:            adminAuthor.DiscordID,
+				Username:      adminAuthor.Name,
+				Discriminator: adminAuthor.Discriminator,
+			},
+			Attachments: []*discordgo.MessageAttachment{{
+				ID:          messageID + "0",
+				URL:         fmt.Sprintf("%s/attachments/%s/cat.png", cdn.URL, messageID),
+				Filename:    "cat.png",
+				ContentType: "image/png",
+			}},
+		}
+		discordMessages = append(discordMessages, discordMessage)
+		_, err := ronnyd.PersistMessageToDb(db, discordMessage)
+		assert.Nil(t, err)
+		defer db.Unscoped().Delete(&ronnyd.Message{}, "discord_id = ?", messageID)
+
+		var message ronnyd.Message
+		db.Preload("Channel").Preload("Attachments").First(&message, "discord_id = ?", messageID)
+		messages = append(messages, &message)
+	}
+
+	store := ronnyd.OpenBlobStore()
+	assert.NotNil(t, store)
+	for _, message := range messages {
+		assert.Nil(t, ronnyd.ArchiveMessageAttachments(db, store, cdn.Client(), message))
+	}
+	hash := messages[0].Attachments[0].BlobHash
+	assert.Len(t, hash, 64)
+	assert.Equal(t, hash, messages[1].Attachments[0].BlobHash)
+	blobs, _ := filepath.Glob(filepath.Join(os.Getenv("BLOB_STORE_PATH"), "*", "*"))
+	assert.Len(t, blobs, 1)
+
+	// Editing the message sends its attachments again, which shouldn't lose
+	// what we archived
+	edited := *discordMessages[0]
+	editedAt := edited.Timestamp.Add(time.Minute)
+	edited.Content = "edited"
+	edited.EditedTimestamp = &editedAt
+	assert.Nil(t, ronnyd.UpdateMessage(db, &edited))
+	var attachments []ronnyd.Attachment
+	db.Find(&attachments, "message_id = ?", messages[0].ID)
+	assert.Len(t, attachments, 1)
+	assert.Equal(t, messages[0].Attachments[0].ID, attachments[0].ID)
+	assert.Equal(t, hash, attachments[0].BlobHash)
+
+	discordMock := new(MockedDiscord)
+	discordMock.On(
+		"ChannelMessageSendComplex",
+		indexedChannel.DiscordID,
+		mock.MatchedBy(func(data *discordgo.MessageSend) bool {
+			return data.Content == "" && len(data.Files) == 1 && data.Files[0].Name == "cat.png"
+		}),
+	).Return(nil, nil)
+	replayed := ronnyd.PlaybackMessages(discordMock, db, messages[:1])
+	assert.Len(t, replayed, 1)
+	discordMock.AssertExpectations(t)
+}
@@ -7,8 +7,10 @@ import (
 	"github.com/stretchr/testify/mock"
 	"os"
 	"ronald-destroyer/ronnyd"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 func TestMain(m *testing.M) {
@@ -65,7 +67,7 @@ type MockedDiscord struct {
 	mock.Mock
 }
 
-func (m *MockedDiscord) ChannelMessageSend(channelID string, content string) (*discordgo.Message, error) {
+func (m *MockedDiscord) ChannelMessageSend(channelID string, content string, options ...discordgo.RequestOption) (*discordgo.Message, error) {
 	m.Called(channelID, content)
 
 	return &discordgo.Message{
@@ -75,7 +77,105 @@ func (m *MockedDiscord) ChannelMessageSend(channelID string, content string) (*d
 	}, nil
 }
 
+func (m *MockedDiscord) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	m.Called(channelID, data)
+
+	return &discordgo.Message{
+		Content:   data.Content,
+		ChannelID: channelID,
+		GuildID:   "1",
+	}, nil
+}
+
+// sending matches a message sent with this content, the way playback sends
+// them
+func sending(content string) interface{} {
+	return mock.MatchedBy(func(data *discordgo.MessageSend) bool {
+		return data.Content == content
+	})
+}
+
+func (m *MockedDiscord) ChannelMessageDelete(channelID string, messageID string, options ...discordgo.RequestOption) error {
+	args := m.Called(channelID, messageID)
+	return args.Error(0)
+}
+
+func (m *MockedDiscord) ChannelTyping(channelID string, options ...discordgo.RequestOption) error {
+	return nil
+}
+
+func (m *MockedDiscord) ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error) {
+	args := m.Called(channelID, limit, beforeID, afterID, aroundID)
+	return args.Get(0).([]*discordgo.Message), args.Error(1)
+}
+
+func (m *MockedDiscord) Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	args := m.Called(channelID)
+	return args.Get(0).(*discordgo.Channel), args.Error(1)
+}
+
+func (m *MockedDiscord) ChannelDelete(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	args := m.Called(channelID)
+	return args.Get(0).(*discordgo.Channel), args.Error(1)
+}
+
+func (m *MockedDiscord) GuildRoles(guildID string, options ...discordgo.RequestOption) ([]*discordgo.Role, error) {
+	args := m.Called(guildID)
+	return args.Get(0).([]*discordgo.Role), args.Error(1)
+}
+
+func (m *MockedDiscord) ThreadStart(channelID, name string, typ discordgo.ChannelType, archiveDuration int, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	args := m.Called(channelID, name, typ, archiveDuration)
+	return args.Get(0).(*discordgo.Channel), args.Error(1)
+}
+
+func (m *MockedDiscord) ForumThreadStart(channelID, name string, archiveDuration int, content string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	args := m.Called(channelID, name, archiveDuration, content)
+	return args.Get(0).(*discordgo.Channel), args.Error(1)
+}
+
+func (m *MockedDiscord) ThreadsArchived(channelID string, before *time.Time, limit int, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error) {
+	args := m.Called(channelID, before, limit)
+	return args.Get(0).(*discordgo.ThreadsList), args.Error(1)
+}
+
+func (m *MockedDiscord) GuildThreadsActive(guildID string, options ...discordgo.RequestOption) (*discordgo.ThreadsList, error) {
+	args := m.Called(guildID)
+	return args.Get(0).(*discordgo.ThreadsList), args.Error(1)
+}
+
+func (m *MockedDiscord) UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	args := m.Called(recipientID)
+	return args.Get(0).(*discordgo.Channel), args.Error(1)
+}
+
+func (m *MockedDiscord) ChannelWebhooks(channelID string, options ...discordgo.RequestOption) ([]*discordgo.Webhook, error) {
+	args := m.Called(channelID)
+	return args.Get(0).([]*discordgo.Webhook), args.Error(1)
+}
+
+func (m *MockedDiscord) WebhookCreate(channelID, name, avatar string, options ...discordgo.RequestOption) (*discordgo.Webhook, error) {
+	args := m.Called(channelID, name, avatar)
+	return args.Get(0).(*discordgo.Webhook), args.Error(1)
+}
+
+func (m *MockedDiscord) WebhookExecute(webhookID, token string, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	args := m.Called(webhookID, token, wait, data)
+	return args.Get(0).(*discordgo.Message), args.Error(1)
+}
+
+func (m *MockedDiscord) WebhookThreadExecute(webhookID, token string, wait bool, threadID string, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	args := m.Called(webhookID, token, wait, threadID, data)
+	return args.Get(0).(*discordgo.Message), args.Error(1)
+}
+
+func (m *MockedDiscord) WebhookMessageDelete(webhookID, token, messageID string, options ...discordgo.RequestOption) error {
+	args := m.Called(webhookID, token, messageID)
+	return args.Error(0)
+}
+
 func TestSendPlayback(t *testing.T) {
+	useFakeClock(t)
 	db := ronnyd.ConnectToDB()
 	var message1 ronnyd.Message
 	// we just happen to know which random message we're gonna select for playback
@@ -87,7 +187,7 @@ func TestSendPlayback(t *testing.T) {
 	}
 
 	discordMock := new(MockedDiscord)
-	discordMock.On("ChannelMessageSend", message1.Channel.DiscordID, message1.Content).Return(discordMessage1, nil)
+	discordMock.On("ChannelMessageSendComplex", message1.Channel.DiscordID, sending(message1.Content)).Return(discordMessage1, nil)
 	messagesReplayed := ronnyd.RunPlayback(discordMock, os.Getenv("ADMIN_DISCORD_ID"))
 	assert.Len(t, messagesReplayed, 1)
 	assert.Less(t, time.Since(messagesReplayed[0].ReplayedAt), 5*time.Second)
@@ -101,6 +201,7 @@ func TestSendPlayback(t *testing.T) {
 }
 
 func TestWontReplayIndexCommands(t *testing.T) {
+	useFakeClock(t)
 	db := ronnyd.ConnectToDB()
 	var indexedChannel ronnyd.Channel
 	db.First(&indexedChannel)
@@ -130,7 +231,7 @@ func TestWontReplayIndexCommands(t *testing.T) {
 	db.Preload("Channel").Preload("Author").First(&message1, "discord_id = ?", "1053070231075029074")
 
 	discordMock := new(MockedDiscord)
-	discordMock.On("ChannelMessageSend", message1.Channel.DiscordID, message1.Content).Return(discordgo.Message{}, nil)
+	discordMock.On("ChannelMessageSendComplex", message1.Channel.DiscordID, sending(message1.Content)).Return(discordgo.Message{}, nil)
 
 	messagesReplayed := ronnyd.RunPlayback(discordMock, os.Getenv("ADMIN_DISCORD_ID"))
 	assert.Len(t, messagesReplayed, 1)
@@ -182,14 +283,21 @@ func TestUpdateMessage(t *testing.T) {
 		t.Fail()
 	}
 
-	var message1 ronnyd.Message
-	db.Last(&message1, "discord_id = ?", discordMessage1.ID)
+	var messageCount int64
+	db.Model(&ronnyd.Message{}).Where("discord_id = ?", discordMessage1.ID).Count(&messageCount)
+	assert.Equal(t, int64(1), messageCount)
 
+	var message1 ronnyd.Message
+	db.First(&message1, "discord_id = ?", discordMessage1.ID)
+	assert.Equal(t, message1.ID, persistedMessage.ID)
 	assert.Equal(t, message1.Content, "hi hi hi hi")
+	assert.True(t, message1.EditedAt.Equal(now))
 
-	db.First(&persistedMessage, "discord_id = ?", discordMessage1.ID)
-	assert.Equal(t, persistedMessage.Content, "hi hi hi")
-	assert.True(t, persistedMessage.EditedAt.Equal(now))
+	revisions := ronnyd.GetMessageRevisions(db, message1.ID)
+	assert.Len(t, revisions, 2)
+	assert.Equal(t, revisions[0].Content, "hi hi hi")
+	assert.Equal(t, revisions[1].Content, "hi hi hi hi")
+	assert.Equal(t, *message1.CurrentRevisionID, revisions[1].ID)
 }
 // TODO: Send multiple messages and assert they get batched correctly
 
@@ -233,4 +341,50 @@ func TestEditedMessageNoEditTimestamp(t *testing.T){
 
 	assert.Equal(t, message1.Content, "hi hi hi")
 	assert.LessOrEqual(t, message1.EditedAt, time.Time{})
-}
\ No newline at end of file
+}
+
+func TestDeletedMessagesAreNotReplayed(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var indexedChannel ronnyd.Channel
+	db.First(&indexedChannel)
+	var adminAuthor ronnyd.Author
+	db.First(&adminAuthor, "discord_id = ?", os.Getenv("ADMIN_DISCORD_ID"))
+
+	discordMessage1 := &discordgo.Message{
+		Content:   "delete me",
+		ChannelID: fmt.Sprint(indexedChannel.DiscordID),
+		GuildID:   fmt.Sprint(indexedChannel.GuildId),
+		Timestamp: time.Now(),
+		ID:        "12345678",
+		Author: &discordgo.User{
+			ID:            adminAuthor.DiscordID,
+			Username:      adminAuthor.Name,
+			Discriminator: adminAuthor.Discriminator,
+		},
+	}
+	_, err := ronnyd.PersistMessageToDb(db, discordMessage1)
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(&ronnyd.Message{}, "discord_id = ?", discordMessage1.ID)
+
+	deleted, err := ronnyd.TombstoneMessages(db, []string{discordMessage1.ID, "not a stored message"}, time.Now(), true)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	for _, session := range ronnyd.GetMessagesForPlayback(db, adminAuthor.DiscordID) {
+		for _, message := range session {
+			assert.NotEqual(t, discordMessage1.ID, message.DiscordID)
+		}
+	}
+
+	deletedMessages := ronnyd.GetRecentlyDeletedMessages(db, indexedChannel.GuildId, 10)
+	assert.NotEmpty(t, deletedMessages)
+	assert.Equal(t, discordMessage1.ID, deletedMessages[0].DiscordID)
+	assert.True(t, deletedMessages[0].DeletedByModerator)
+}
+
+func TestFormatDeletedMessagesKeepsCharactersWhole(t *testing.T) {
+	formatted := ronnyd.FormatDeletedMessages([]*ronnyd.Message{{Content: strings.Repeat("é", 150)}})
+	assert.True(t, utf8.ValidString(formatted))
+	assert.Contains(t, formatted, strings.Repeat("é", 100)+"...")
+	assert.NotContains(t, formatted, strings.Repeat("é", 101))
+}
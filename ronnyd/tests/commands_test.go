@@ -0,0 +1,133 @@
+package tests
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestCommandRouter(t *testing.T) {
+	var ran map[string]interface{}
+	router := ronnyd.NewCommandRouter("echo")
+	router.Register(&ronnyd.Command{
+		Name:    "echo",
+		Aliases: []string{"say"},
+		Args: []ronnyd.ArgSpec{
+			{Name: "count", Type: ronnyd.ARG_INT, Optional: true},
+		},
+		Handler: func(ctx *ronnyd.CommandContext) error {
+			ran = ctx.Args
+			return nil
+		},
+	})
+	router.Register(&ronnyd.Command{
+		Name: "remind",
+		Args: []ronnyd.ArgSpec{
+			{Name: "who", Type: ronnyd.ARG_USER},
+			{Name: "in", Type: ronnyd.ARG_DURATION},
+			{Name: "what", Type: ronnyd.ARG_STRING, Rest: true},
+		},
+		Permission: ronnyd.PERMISSION_ADMIN,
+		Handler: func(ctx *ronnyd.CommandContext) error {
+			ran = ctx.Args
+			return nil
+		},
+	})
+
+	discordMock := new(MockedDiscord)
+	discordMock.On("ChannelMessageSendComplex", "1", mock.Anything).Return(nil, nil)
+	context := func(authorID string) *ronnyd.CommandContext {
+		return &ronnyd.CommandContext{
+			Session:   discordMock,
+			Guild:     ronnyd.DefaultGuildSettings(),
+			ChannelID: "1",
+			AuthorID:  authorID,
+		}
+	}
+	admin := os.Getenv("ADMIN_DISCORD_ID")
+
+	assert.Nil(t, router.Dispatch(context(admin), ""))
+	assert.Empty(t, ran)
+	assert.Nil(t, router.Dispatch(context(admin), " 50"))
+	assert.Equal(t, 50, ran["count"])
+	assert.Nil(t, router.Dispatch(context(admin), "say 5"))
+	assert.Equal(t, 5, ran["count"])
+	assert.Nil(t, router.Dispatch(context(admin), "remind <@!123> 1h take out the bins"))
+	assert.Equal(t, "123", ran["who"])
+	assert.Equal(t, time.Hour, ran["in"])
+	assert.Equal(t, "take out the bins", ran["what"])
+
+	ran = nil
+	assert.Nil(t, router.Dispatch(context(admin), "say lots"))
+	assert.Nil(t, router.Dispatch(context(admin), "remind someone 1h bins"))
+	assert.Nil(t, router.Dispatch(context(admin), "remnid <@123> 1h bins"))
+	assert.Nil(t, router.Dispatch(context("1234"), "remind <@123> 1h bins"))
+	assert.Nil(t, ran)
+	assertReplied(t, discordMock, "count must be a positive number\nUsage: index! echo [count]")
+	assertReplied(t, discordMock, "Unknown command remnid, try help")
+	assertReplied(t, discordMock, "You don't have permission to use remind")
+}
+
+func TestPrivateCommandRepliesByDM(t *testing.T) {
+	router := ronnyd.NewCommandRouter("secret")
+	router.Register(&ronnyd.Command{
+		Name:    "secret",
+		Private: true,
+		Handler: func(ctx *ronnyd.CommandContext) error {
+			return ctx.Reply("just for you")
+		},
+	})
+	discordMock := new(MockedDiscord)
+	discordMock.On("UserChannelCreate", "1234").Return(&discordgo.Channel{ID: "2"}, nil)
+	discordMock.On("ChannelMessageSendComplex", "2", mock.Anything).Return(nil, nil)
+	assert.Nil(t, router.Dispatch(&ronnyd.CommandContext{
+		Session:   discordMock,
+		Guild:     ronnyd.DefaultGuildSettings(),
+		ChannelID: "1",
+		AuthorID:  "1234",
+	}, "secret"))
+	discordMock.AssertCalled(t, "ChannelMessageSendComplex", "2", &discordgo.MessageSend{
+		Content:         "just for you",
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	discordMock.AssertNotCalled(t, "ChannelMessageSendComplex", "1", mock.Anything)
+}
+
+func assertReplied(t *testing.T, discordMock *MockedDiscord, content string) {
+	discordMock.AssertCalled(t, "ChannelMessageSendComplex", "1", &discordgo.MessageSend{
+		Content:         content,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+}
+
+func TestCommandHelp(t *testing.T) {
+	ctx := &ronnyd.CommandContext{Guild: ronnyd.DefaultGuildSettings(), AuthorID: "1234"}
+	help := ronnyd.Commands.Help(ctx)
+	assert.Contains(t, help, "`index! help`")
+	assert.NotContains(t, help, "index! set")
+
+	ctx.AuthorID = os.Getenv("ADMIN_DISCORD_ID")
+	help = ronnyd.Commands.Help(ctx)
+	assert.Contains(t, help, "`index! set <setting> <value>`")
+	assert.Contains(t, help, "`index! more [count]` Keep indexing from where the last index stopped (also resume)")
+}
+
+func TestApplicationCommands(t *testing.T) {
+	commands := make(map[string]*discordgo.ApplicationCommand)
+	for _, command := range ronnyd.Commands.ApplicationCommands() {
+		assert.NotEmpty(t, command.Description)
+		commands[command.Name] = command
+	}
+	assert.Contains(t, commands, "stats")
+	assert.Len(t, commands["index"].Options, 2)
+	assert.Equal(t, discordgo.ApplicationCommandOptionInteger, commands["index"].Options[0].Type)
+	assert.False(t, commands["index"].Options[0].Required)
+	assert.Equal(t, discordgo.ApplicationCommandOptionChannel, commands["index"].Options[1].Type)
+	assert.Len(t, commands["set"].Options[0].Choices, len(ronnyd.GUILD_SETTINGS))
+	assert.True(t, commands["set"].Options[1].Required)
+}
@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestPlaybackQuotas(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	guild := &ronnyd.Guild{DiscordID: "4343", DailyQuota: 2, WeeklyQuota: 3, ChannelCooldown: time.Hour}
+	defer db.Unscoped().Delete(&ronnyd.PlaybackCooldown{}, "guild_id = ?", guild.DiscordID)
+
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, ronnyd.CheckPlaybackQuota(db, guild, start))
+	assert.Nil(t, ronnyd.RecordPlayback(db, guild.DiscordID, "1", "10", start))
+	assert.Nil(t, ronnyd.RecordPlayback(db, guild.DiscordID, "2", "11", start.Add(time.Hour)))
+
+	var blocked *ronnyd.PlaybackBlockedError
+	assert.ErrorAs(t, ronnyd.CheckPlaybackQuota(db, guild, start.Add(2*time.Hour)), &blocked)
+	assert.Equal(t, 22*time.Hour, blocked.Remaining)
+	assert.ErrorAs(t, ronnyd.CheckChannelCooldown(db, guild, "11", start.Add(90*time.Minute)), &blocked)
+	assert.Equal(t, 30*time.Minute, blocked.Remaining)
+	assert.Nil(t, ronnyd.CheckChannelCooldown(db, guild, "10", start.Add(90*time.Minute)))
+	assert.ErrorAs(t, ronnyd.CheckTargetCooldown(db, guild, "1", start.Add(time.Hour)), &blocked)
+
+	// A new day, but the week's quota runs out
+	assert.Nil(t, ronnyd.CheckPlaybackQuota(db, guild, start.Add(25*time.Hour)))
+	assert.Nil(t, ronnyd.RecordPlayback(db, guild.DiscordID, "1", "10", start.Add(25*time.Hour)))
+	assert.ErrorAs(t, ronnyd.CheckPlaybackQuota(db, guild, start.Add(50*time.Hour)), &blocked)
+	assert.Equal(t, 5*24*time.Hour-2*time.Hour, blocked.Remaining)
+	assert.Contains(t, blocked.Error(), "this week's playbacks, try again in 118h0m0s")
+	assert.Nil(t, ronnyd.CheckPlaybackQuota(db, guild, start.Add(8*24*time.Hour)))
+
+	targetCooldown := ronnyd.GetPlaybackCooldown(db, guild.DiscordID, ronnyd.COOLDOWN_SCOPE_TARGET, "1")
+	assert.Equal(t, 2, targetCooldown.WeekCount)
+}
+
+func TestPlaybackCooldown(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var message ronnyd.Message
+	db.Preload("Channel").Preload("Author").First(&message, "discord_id = ?", "1053070231075029074")
+	guild, err := ronnyd.GetGuildSettings(db, message.Channel.GuildId)
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(&ronnyd.Guild{}, guild.ID)
+
+	assert.True(t, ronnyd.LastReplayedAt(db, message.Author.DiscordID, guild.DiscordID).IsZero())
+	db.Model(&message).Update("replayed_at", time.Now().Add(-time.Hour))
+	defer db.Model(&message).Update("replayed_at", time.Time{})
+
+	discordMock := new(MockedDiscord)
+	run, err := ronnyd.RunPlaybackRequest(discordMock, db, &ronnyd.PlaybackRequest{
+		TargetID: message.Author.DiscordID,
+		Guild:    guild,
+	})
+	defer db.Unscoped().Delete(run)
+	assert.Empty(t, run.Replayed)
+	assert.Equal(t, ronnyd.PLAYBACK_OUTCOME_BLOCKED, run.Outcome)
+	var blocked *ronnyd.PlaybackBlockedError
+	assert.ErrorAs(t, err, &blocked)
+	assert.InDelta(t, (23 * time.Hour).Seconds(), blocked.Remaining.Seconds(), 60)
+	discordMock.AssertNotCalled(t, "ChannelMessageSendComplex", mock.Anything, mock.Anything)
+}
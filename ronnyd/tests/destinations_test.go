@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestPlaybackDestinationsSetting(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	guild, err := ronnyd.GetGuildSettings(db, "4343")
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(&ronnyd.Guild{}, guild.ID)
+
+	assert.Nil(t, ronnyd.UpdateGuildSetting(db, guild, "playback_destinations", "<#1>=<#2>, 3=<#4>"))
+	assert.NotNil(t, ronnyd.UpdateGuildSetting(db, guild, "playback_destinations", "<#1>"))
+	reloaded, err := ronnyd.GetGuildSettings(db, "4343")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"1": "2", "3": "4"}, reloaded.PlaybackDestinations)
+
+	assert.Nil(t, ronnyd.UpdateGuildSetting(db, guild, "playback_destinations", "none"))
+	reloaded, err = ronnyd.GetGuildSettings(db, "4343")
+	assert.Nil(t, err)
+	assert.Empty(t, reloaded.PlaybackDestinations)
+}
+
+// everyoneRole is the @everyone role for guildID, with permissions
+func everyoneRole(guildID string, permissions int64) []*discordgo.Role {
+	return []*discordgo.Role{{ID: guildID, Permissions: permissions}}
+}
+
+func TestIsChannelPrivate(t *testing.T) {
+	hidden := []*discordgo.PermissionOverwrite{{
+		ID:   "10",
+		Type: discordgo.PermissionOverwriteTypeRole,
+		Deny: discordgo.PermissionViewChannel,
+	}}
+	discordMock := new(MockedDiscord)
+	discordMock.On("GuildRoles", "10").Return(everyoneRole("10", discordgo.PermissionViewChannel), nil)
+	discordMock.On("Channel", "11").Return(&discordgo.Channel{ID: "11", GuildID: "10", PermissionOverwrites: hidden}, nil)
+
+	assert.False(t, ronnyd.IsChannelPrivate(discordMock, &discordgo.Channel{ID: "12", GuildID: "10"}))
+	assert.True(t, ronnyd.IsChannelPrivate(discordMock, &discordgo.Channel{ID: "11", GuildID: "10", PermissionOverwrites: hidden}))
+	assert.True(t, ronnyd.IsChannelPrivate(discordMock, &discordgo.Channel{ID: "13", GuildID: "10", Type: discordgo.ChannelTypeGuildPrivateThread}))
+	// A public thread in a hidden channel is just as hidden
+	assert.True(t, ronnyd.IsChannelPrivate(discordMock, &discordgo.Channel{ID: "14", GuildID: "10", Type: discordgo.ChannelTypeGuildPublicThread, ParentID: "11"}))
+
+	// Servers where @everyone can't see channels unless they're opened up
+	closed := new(MockedDiscord)
+	closed.On("GuildRoles", "20").Return(everyoneRole("20", discordgo.PermissionSendMessages), nil)
+	assert.True(t, ronnyd.IsChannelPrivate(closed, &discordgo.Channel{ID: "21", GuildID: "20"}))
+	assert.False(t, ronnyd.IsChannelPrivate(closed, &discordgo.Channel{ID: "22", GuildID: "20", PermissionOverwrites: []*discordgo.PermissionOverwrite{{
+		ID:    "20",
+		Type:  discordgo.PermissionOverwriteTypeRole,
+		Allow: discordgo.PermissionViewChannel,
+	}}}))
+}
+
+func TestPrivateChannelsOnlyReplayIntoThemselves(t *testing.T) {
+	hidden := []*discordgo.PermissionOverwrite{{
+		ID:   "30",
+		Type: discordgo.PermissionOverwriteTypeRole,
+		Deny: discordgo.PermissionViewChannel,
+	}}
+	discordMock := new(MockedDiscord)
+	discordMock.On("GuildRoles", "30").Return(everyoneRole("30", discordgo.PermissionViewChannel), nil)
+	discordMock.On("Channel", "31").Return(&discordgo.Channel{ID: "31", GuildID: "30", PermissionOverwrites: hidden}, nil)
+	// Just as hidden, but maybe not from the same people
+	discordMock.On("Channel", "32").Return(&discordgo.Channel{ID: "32", GuildID: "30", PermissionOverwrites: hidden}, nil)
+	discordMock.On("Channel", "33").Return(&discordgo.Channel{ID: "33", GuildID: "30", Type: discordgo.ChannelTypeGuildPublicThread, ParentID: "31"}, nil)
+	discordMock.On("Channel", "34").Return(&discordgo.Channel{ID: "34", GuildID: "30", Type: discordgo.ChannelTypeGuildPrivateThread, ParentID: "31"}, nil)
+	guild := ronnyd.DefaultGuildSettings()
+
+	assert.Nil(t, ronnyd.CheckPlaybackDestination(discordMock, guild, "31", "31"))
+	assert.IsType(t, &ronnyd.PlaybackBlockedError{}, ronnyd.CheckPlaybackDestination(discordMock, guild, "31", "32"))
+	assert.Nil(t, ronnyd.CheckPlaybackDestination(discordMock, guild, "33", "31"))
+	assert.IsType(t, &ronnyd.PlaybackBlockedError{}, ronnyd.CheckPlaybackDestination(discordMock, guild, "34", "31"))
+}
+
+func TestPlaybackIntoAnotherChannel(t *testing.T) {
+	useFakeClock(t)
+	db := ronnyd.ConnectToDB()
+	author := &discordgo.User{ID: "9696", Username: "elsewhere", Discriminator: "0001"}
+	start := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	indexedChannel, messages := persistTestMessages(
+		t, db, author, start,
+		[]string{"elsewhere 0", "elsewhere 1"},
+		[]time.Duration{0, time.Minute},
+	)
+
+	guildID := indexedChannel.GuildId
+	hidden := []*discordgo.PermissionOverwrite{{
+		ID:   guildID,
+		Type: discordgo.PermissionOverwriteTypeRole,
+		Deny: discordgo.PermissionViewChannel,
+	}}
+	roles := everyoneRole(guildID, discordgo.PermissionViewChannel)
+	discordMock := new(MockedDiscord)
+	discordMock.On("GuildRoles", guildID).Return(roles, nil)
+	discordMock.On("Channel", indexedChannel.DiscordID).Return(&discordgo.Channel{ID: indexedChannel.DiscordID, GuildID: guildID}, nil)
+	discordMock.On("Channel", "9696100").Return(&discordgo.Channel{ID: "9696100", GuildID: guildID}, nil)
+	discordMock.On("Channel", "9696200").Return(&discordgo.Channel{ID: "9696200", GuildID: "somewhere else"}, nil)
+	discordMock.On("ChannelMessageSendComplex", "9696100", mock.Anything).Return(nil, nil)
+
+	guild := &ronnyd.Guild{PlaybackDestinations: map[string]string{indexedChannel.DiscordID: "9696100"}}
+	run, err := ronnyd.RunPlaybackRequest(discordMock, db, &ronnyd.PlaybackRequest{TargetID: author.ID, Guild: guild})
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(run)
+	assert.Len(t, run.Replayed, 2)
+	discordMock.AssertNumberOfCalls(t, "ChannelMessageSendComplex", 2)
+	discordMock.AssertNotCalled(t, "ChannelMessageSendComplex", indexedChannel.DiscordID, mock.Anything)
+	// So there's something left to try replaying
+	db.Model(&ronnyd.Message{}).Where("id IN ?", []uint{messages[0].ID, messages[1].ID}).Update("replayed_at", time.Time{})
+
+	blocked, err := ronnyd.RunPlaybackRequest(discordMock, db, &ronnyd.PlaybackRequest{
+		TargetID:             author.ID,
+		Guild:                ronnyd.DefaultGuildSettings(),
+		DestinationChannelID: "9696200",
+	})
+	defer db.Unscoped().Delete(blocked)
+	assert.IsType(t, &ronnyd.PlaybackBlockedError{}, err)
+
+	// Nothing said in a hidden channel gets replayed somewhere everyone can see
+	private := new(MockedDiscord)
+	private.On("GuildRoles", guildID).Return(roles, nil)
+	private.On("Channel", indexedChannel.DiscordID).Return(&discordgo.Channel{ID: indexedChannel.DiscordID, GuildID: guildID, PermissionOverwrites: hidden}, nil)
+	private.On("Channel", "9696100").Return(&discordgo.Channel{ID: "9696100", GuildID: guildID}, nil)
+	blocked, err = ronnyd.RunPlaybackRequest(private, db, &ronnyd.PlaybackRequest{
+		TargetID:             author.ID,
+		Guild:                ronnyd.DefaultGuildSettings(),
+		DestinationChannelID: "9696100",
+	})
+	defer db.Unscoped().Delete(blocked)
+	assert.IsType(t, &ronnyd.PlaybackBlockedError{}, err)
+	private.AssertNotCalled(t, "ChannelMessageSendComplex", mock.Anything, mock.Anything)
+
+	// Or from a hidden channel the session moved on to
+	hiddenChannel, err := ronnyd.PersistChannelToDB(db, "9696300", guildID)
+	assert.Nil(t, err)
+	_, err = ronnyd.PersistMessageToDb(db, &discordgo.Message{
+		ID:        "9696301",
+		ChannelID: hiddenChannel.DiscordID,
+		Content:   "elsewhere hidden",
+		Timestamp: start.Add(2 * time.Minute),
+		Author:    author,
+	})
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		db.Unscoped().Delete(&ronnyd.Message{}, "channel_id = ?", hiddenChannel.ID)
+		db.Unscoped().Delete(hiddenChannel)
+	})
+	moved := new(MockedDiscord)
+	moved.On("GuildRoles", guildID).Return(roles, nil)
+	moved.On("Channel", indexedChannel.DiscordID).Return(&discordgo.Channel{ID: indexedChannel.DiscordID, GuildID: guildID}, nil)
+	moved.On("Channel", hiddenChannel.DiscordID).Return(&discordgo.Channel{ID: hiddenChannel.DiscordID, GuildID: guildID, PermissionOverwrites: hidden}, nil)
+	moved.On("Channel", "9696100").Return(&discordgo.Channel{ID: "9696100", GuildID: guildID}, nil)
+	blocked, err = ronnyd.RunPlaybackRequest(moved, db, &ronnyd.PlaybackRequest{
+		TargetID:             author.ID,
+		Guild:                ronnyd.DefaultGuildSettings(),
+		DestinationChannelID: "9696100",
+	})
+	defer db.Unscoped().Delete(blocked)
+	assert.IsType(t, &ronnyd.PlaybackBlockedError{}, err)
+	moved.AssertNotCalled(t, "ChannelMessageSendComplex", mock.Anything, mock.Anything)
+}
+
+func TestMemoryLane(t *testing.T) {
+	useFakeClock(t)
+	db := ronnyd.ConnectToDB()
+	author := &discordgo.User{ID: "9797", Username: "reminisce", Discriminator: "0001"}
+	indexedChannel, _ := persistTestMessages(
+		t, db, author,
+		time.Date(2020, 11, 1, 12, 0, 0, 0, time.UTC),
+		[]string{"memory 0", "memory 1"},
+		[]time.Duration{0, time.Minute},
+	)
+	guild := &ronnyd.Guild{DiscordID: indexedChannel.GuildId, ChannelCooldown: time.Hour}
+	defer db.Unscoped().Delete(&ronnyd.PlaybackCooldown{}, "guild_id = ?", guild.DiscordID)
+
+	discordMock := new(MockedDiscord)
+	discordMock.On("ThreadStart", indexedChannel.DiscordID, mock.Anything, discordgo.ChannelTypeGuildPublicThread, mock.Anything).Return(&discordgo.Channel{ID: "9797100"}, nil)
+	discordMock.On("ChannelMessageSendComplex", "9797100", mock.Anything).Return(nil, nil)
+	discordMock.On("ChannelDelete", "9797100").Return(&discordgo.Channel{ID: "9797100"}, nil)
+
+	// A playback in the channel was too recent, so there's no thread
+	assert.Nil(t, ronnyd.RecordPlayback(db, guild.DiscordID, "someone else", indexedChannel.DiscordID, time.Now()))
+	blocked, err := ronnyd.RunPlaybackRequest(discordMock, db, &ronnyd.PlaybackRequest{TargetID: author.ID, Guild: guild, MemoryLane: true})
+	defer db.Unscoped().Delete(blocked)
+	assert.IsType(t, &ronnyd.PlaybackBlockedError{}, err)
+	discordMock.AssertNotCalled(t, "ThreadStart", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+
+	guild.ChannelCooldown = 0
+	run, err := ronnyd.RunPlaybackRequest(discordMock, db, &ronnyd.PlaybackRequest{TargetID: author.ID, Guild: guild, MemoryLane: true})
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(run)
+	assert.Len(t, run.Replayed, 2)
+	assert.Equal(t, "9797100", run.MemoryLaneThreadID)
+
+	_, err = ronnyd.UndoPlaybackRun(discordMock, db, ronnyd.GetPlaybackRun(db, run.ID))
+	assert.Nil(t, err)
+	discordMock.AssertCalled(t, "ChannelDelete", "9797100")
+}
@@ -8,6 +8,9 @@ import (
 	"testing"
 	"time"
 
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
 	"ronald-destroyer/ronnyd"
 )
 
@@ -86,3 +89,41 @@ func LoadDevFixtures(m *testing.M) {
 		db.Create(&insertedMessage)
 	}
 }
+
+var testMessagesPersisted = 0
+
+// persistTestMessages stores a message from user in the first indexed channel
+// for each of contents, offsets[i] after start. Everything the messages leave
+// behind is removed when the test finishes.
+func persistTestMessages(t *testing.T, db *gorm.DB, user *discordgo.User, start time.Time, contents []string, offsets []time.Duration) (*ronnyd.Channel, []*ronnyd.Message) {
+	var indexedChannel ronnyd.Channel
+	db.First(&indexedChannel)
+	discordIDs := make([]string, 0, len(contents))
+	messages := make([]*ronnyd.Message, 0, len(contents))
+	for i, content := range contents {
+		testMessagesPersisted++
+		discordID := fmt.Sprintf("%s%03d", user.ID, testMessagesPersisted)
+		discordIDs = append(discordIDs, discordID)
+		message, err := ronnyd.PersistMessageToDb(db, &discordgo.Message{
+			ID:        discordID,
+			ChannelID: indexedChannel.DiscordID,
+			Content:   content,
+			Timestamp: start.Add(offsets[i]),
+			Author:    user,
+		})
+		assert.Nil(t, err)
+		messages = append(messages, message)
+	}
+	t.Cleanup(func() {
+		db.Unscoped().Delete(&ronnyd.Message{}, "discord_id IN ?", discordIDs)
+		author := ronnyd.GetAuthor(db, user.ID)
+		if author == nil {
+			return
+		}
+		db.Unscoped().Delete(&ronnyd.PlaybackSession{}, "author_id = ?", author.ID)
+		db.Unscoped().Delete(&ronnyd.AuthorHistory{}, "author_id = ?", author.ID)
+		db.Unscoped().Delete(author)
+		db.Unscoped().Delete(&ronnyd.PlaybackWebhook{}, "channel_id = ?", indexedChannel.DiscordID)
+	})
+	return &indexedChannel, messages
+}
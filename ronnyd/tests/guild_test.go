@@ -0,0 +1,59 @@
+package tests
+
+import (
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestGuildSettings(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	guild, err := ronnyd.GetGuildSettings(db, "4242")
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(&ronnyd.Guild{}, guild.ID)
+
+	assert.Equal(t, ronnyd.INDEX_COMMAND, guild.Prefix())
+	assert.Equal(t, ronnyd.DEFAULT_MESSAGES_TO_INDEX, guild.IndexSize())
+	assert.True(t, guild.IsAdmin(os.Getenv("ADMIN_DISCORD_ID"), nil))
+	assert.False(t, guild.IsAdmin("1234", []string{"99"}))
+
+	assert.Nil(t, ronnyd.UpdateGuildSetting(db, guild, "prefix", "ronny!"))
+	assert.Nil(t, ronnyd.UpdateGuildSetting(db, guild, "admin_roles", "<@&99>, 100"))
+	assert.Nil(t, ronnyd.UpdateGuildSetting(db, guild, "index_size", "50"))
+	assert.Nil(t, ronnyd.UpdateGuildSetting(db, guild, "session_gap", "10m"))
+	assert.Nil(t, ronnyd.UpdateGuildSetting(db, guild, "playback_channels", "<#555>"))
+	assert.NotNil(t, ronnyd.UpdateGuildSetting(db, guild, "index_size", "lots"))
+	assert.NotNil(t, ronnyd.UpdateGuildSetting(db, guild, "favourite_colour", "blue"))
+	assert.NotNil(t, ronnyd.UpdateGuildSetting(db, ronnyd.DefaultGuildSettings(), "prefix", "ronny!"))
+
+	reloaded, err := ronnyd.GetGuildSettings(db, "4242")
+	assert.Nil(t, err)
+	assert.Equal(t, guild.ID, reloaded.ID)
+	assert.Equal(t, "ronny!", reloaded.Prefix())
+	assert.Equal(t, []string{"99", "100"}, reloaded.AdminRoleIDs)
+	assert.Equal(t, 50, reloaded.IndexSize())
+	assert.Equal(t, 10*time.Minute, reloaded.Gap())
+	assert.Equal(t, []string{"555"}, reloaded.AllowedPlaybackChannelIDs)
+	assert.True(t, reloaded.IsAdmin("1234", []string{"99"}))
+	assert.True(t, reloaded.IsCommand("ronny! settings"))
+}
+
+func TestPlaybackChannelsLimitDestinations(t *testing.T) {
+	guild := &ronnyd.Guild{
+		AllowedPlaybackChannelIDs: []string{"2", "5"},
+		PlaybackDestinations:      map[string]string{"1": "2", "3": "4", "5": "6"},
+	}
+	assert.True(t, guild.CanPlaybackIn("2"))
+	assert.False(t, guild.CanPlaybackIn("1"))
+	// Sources are wherever ends up replayed into an allowed channel
+	sources := guild.PlaybackSourceChannelIDs()
+	sort.Strings(sources)
+	assert.Equal(t, []string{"1", "2"}, sources)
+
+	assert.True(t, ronnyd.DefaultGuildSettings().CanPlaybackIn("1"))
+	assert.Nil(t, ronnyd.DefaultGuildSettings().PlaybackSourceChannelIDs())
+}
@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"ronald-destroyer/ronnyd"
+)
+
+// FakeClock records sleeps instead of waiting, and moves its time on by them
+type FakeClock struct {
+	mu     sync.Mutex
+	start  time.Time
+	Sleeps []time.Duration
+}
+
+func NewFakeClock() *FakeClock {
+	return &FakeClock{start: time.Now()}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	now := clock.start
+	for _, d := range clock.Sleeps {
+		now = now.Add(d)
+	}
+	return now
+}
+
+func (clock *FakeClock) Sleep(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	clock.Sleeps = append(clock.Sleeps, d)
+}
+
+// useFakeClock swaps in a FakeClock for playback until the test is done
+func useFakeClock(t *testing.T) *FakeClock {
+	clock := NewFakeClock()
+	previous := ronnyd.PlaybackClock
+	ronnyd.PlaybackClock = clock
+	t.Cleanup(func() { ronnyd.PlaybackClock = previous })
+	return clock
+}
+
+type TypingDiscord struct {
+	MockedDiscord
+}
+
+func (m *TypingDiscord) ChannelTyping(channelID string, options ...discordgo.RequestOption) error {
+	args := m.Called(channelID)
+	return args.Error(0)
+}
+
+func TestPlaybackDelay(t *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(offset time.Duration) *ronnyd.Message {
+		return &ronnyd.Message{MessageTimestamp: start.Add(offset)}
+	}
+	assert.Equal(t, time.Duration(0), ronnyd.PlaybackDelay(nil, at(0)))
+	assert.Equal(t, ronnyd.PLAYBACK_MIN_DELAY, ronnyd.PlaybackDelay(at(0), at(time.Second)))
+	assert.Equal(t, 5*time.Second, ronnyd.PlaybackDelay(at(0), at(10*time.Second)))
+	assert.Equal(t, ronnyd.PLAYBACK_MAX_DELAY, ronnyd.PlaybackDelay(at(0), at(time.Hour)))
+
+	assert.Equal(t, time.Duration(0), ronnyd.TypingDuration(&ronnyd.Message{}))
+	assert.Equal(t, 2*time.Second, ronnyd.TypingDuration(&ronnyd.Message{Content: strings.Repeat("a", 50)}))
+	// Characters, not bytes, so emoji don't take four times as long
+	assert.Equal(t, 2*time.Second, ronnyd.TypingDuration(&ronnyd.Message{Content: strings.Repeat("🍕", 50)}))
+	assert.Equal(t, ronnyd.PLAYBACK_MAX_TYPING, ronnyd.TypingDuration(&ronnyd.Message{Content: strings.Repeat("a", 5000)}))
+}
+
+func TestPlaybackIsPaced(t *testing.T) {
+	clock := useFakeClock(t)
+
+	db := ronnyd.ConnectToDB()
+	author := &discordgo.User{ID: "9595", Username: "paced", Discriminator: "0001"}
+	indexedChannel, _ := persistTestMessages(
+		t, db, author,
+		time.Date(2020, 9, 1, 12, 0, 0, 0, time.UTC),
+		// 25 characters is a second of typing, and there's nothing to send
+		// for the empty one
+		[]string{strings.Repeat("a", 25), "", strings.Repeat("b", 50)},
+		[]time.Duration{0, 10 * time.Second, 20 * time.Second},
+	)
+
+	discordMock := new(TypingDiscord)
+	discordMock.On("ChannelTyping", indexedChannel.DiscordID).Return(nil)
+	discordMock.On("ChannelMessageSendComplex", indexedChannel.DiscordID, mock.Anything).Return(nil, nil)
+	run, err := ronnyd.RunPlaybackRequest(discordMock, db, &ronnyd.PlaybackRequest{
+		TargetID: author.ID,
+		Guild:    ronnyd.DefaultGuildSettings(),
+	})
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(run)
+	assert.Len(t, run.Replayed, 2)
+	discordMock.AssertNumberOfCalls(t, "ChannelTyping", 2)
+	// Typing for the first, then half the 20 second gap for the last, the
+	// last 2 seconds of it typing. The skipped message doesn't wait at all.
+	assert.Equal(t, []time.Duration{time.Second, 8 * time.Second, 2 * time.Second}, clock.Sleeps, fmt.Sprint(clock.Sleeps))
+}
+
+func TestWebhookPlaybackIsPacedWithoutTyping(t *testing.T) {
+	clock := useFakeClock(t)
+	db := ronnyd.ConnectToDB()
+	author := &discordgo.User{ID: "9596", Username: "pacedhook", Discriminator: "0001"}
+	indexedChannel, _ := persistTestMessages(
+		t, db, author,
+		time.Date(2020, 9, 2, 12, 0, 0, 0, time.UTC),
+		[]string{strings.Repeat("a", 25), strings.Repeat("b", 50)},
+		[]time.Duration{0, 20 * time.Second},
+	)
+
+	discordMock := new(TypingDiscord)
+	discordMock.On("Channel", indexedChannel.DiscordID).Return(&discordgo.Channel{ID: indexedChannel.DiscordID, Type: discordgo.ChannelTypeGuildText}, nil)
+	discordMock.On("ChannelWebhooks", indexedChannel.DiscordID).Return([]*discordgo.Webhook{}, nil)
+	discordMock.On("WebhookCreate", indexedChannel.DiscordID, ronnyd.PLAYBACK_WEBHOOK_NAME, "").Return(&discordgo.Webhook{ID: "78", Token: "token"}, nil)
+	discordMock.On("WebhookExecute", "78", "token", true, mock.Anything).Return(&discordgo.Message{ID: "8101"}, nil)
+	run, err := ronnyd.RunPlaybackRequest(discordMock, db, &ronnyd.PlaybackRequest{
+		TargetID: author.ID,
+		Guild:    &ronnyd.Guild{PlaybackDelivery: ronnyd.PLAYBACK_DELIVERY_WEBHOOK},
+	})
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(run)
+	assert.Len(t, run.Replayed, 2)
+	// The same waits, just without the bot typing
+	discordMock.AssertNotCalled(t, "ChannelTyping", mock.Anything)
+	assert.Equal(t, []time.Duration{time.Second, 8 * time.Second, 2 * time.Second}, clock.Sleeps, fmt.Sprint(clock.Sleeps))
+}
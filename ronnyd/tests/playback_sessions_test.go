@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestPlaybackSessionsAreKeptUpToDate(t *testing.T) {
+	useFakeClock(t)
+	db := ronnyd.ConnectToDB()
+	var indexedChannel ronnyd.Channel
+	db.First(&indexedChannel)
+	guild := &ronnyd.Guild{DiscordID: indexedChannel.GuildId}
+	author := &discordgo.User{ID: "9292", Username: "sessions", Discriminator: "0001"}
+	start := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+	persist := func(offset time.Duration) {
+		_, messages := persistTestMessages(t, db, author, start, []string{fmt.Sprint("session ", offset)}, []time.Duration{offset})
+		assert.Nil(t, ronnyd.AddToPlaybackSession(db, guild, messages[0]))
+	}
+
+	persist(0)
+	persist(2 * time.Minute)
+	persist(30 * time.Minute)
+	stored := ronnyd.GetAuthor(db, author.ID)
+	sessions := ronnyd.GetPlaybackSessions(db, guild.DiscordID, stored.ID, ronnyd.PLAYBACK_SESSIONS_TO_LIST)
+	assert.Len(t, sessions, 2)
+	assert.Equal(t, 1, sessions[0].MessageCount)
+	assert.Equal(t, 2, sessions[1].MessageCount)
+
+	// Scraping an older message regroups the author's sessions, without
+	// changing the IDs they're listed with
+	listed := sessions
+	persist(-2 * time.Minute)
+	sessions = ronnyd.GetPlaybackSessions(db, guild.DiscordID, stored.ID, ronnyd.PLAYBACK_SESSIONS_TO_LIST)
+	assert.Len(t, sessions, 2)
+	assert.Equal(t, listed[0].ID, sessions[0].ID)
+	assert.Equal(t, listed[1].ID, sessions[1].ID)
+	assert.Equal(t, 3, sessions[1].MessageCount)
+	assert.Equal(t, start.Add(-2*time.Minute).Unix(), sessions[1].StartedAt.Unix())
+	assert.Nil(t, ronnyd.EnsurePlaybackSessions(db, guild, stored.ID))
+
+	discordMock := new(MockedDiscord)
+	discordMock.On("ChannelMessageSendComplex", indexedChannel.DiscordID, mock.Anything).Return(nil, nil)
+	run, err := ronnyd.RunPlaybackRequest(discordMock, db, &ronnyd.PlaybackRequest{
+		TargetID:  author.ID,
+		Guild:     ronnyd.DefaultGuildSettings(),
+		SessionID: sessions[1].ID,
+	})
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(run)
+	assert.Len(t, run.Replayed, 3)
+	replayed := ronnyd.GetPlaybackSession(db, sessions[1].ID)
+	assert.False(t, replayed.ReplayedAt.IsZero())
+	assert.True(t, ronnyd.GetPlaybackSession(db, sessions[0].ID).ReplayedAt.IsZero())
+	assert.Contains(t, replayed.Summary(), "3 messages over 4m0s, replayed")
+
+	_, err = ronnyd.UndoPlaybackRun(discordMock, db, ronnyd.GetPlaybackRun(db, run.ID))
+	assert.Nil(t, err)
+	assert.True(t, ronnyd.GetPlaybackSession(db, sessions[1].ID).ReplayedAt.IsZero())
+}
+
+func TestStoredSessionsFollowTheGuildsSettings(t *testing.T) {
+	useFakeClock(t)
+	db := ronnyd.ConnectToDB()
+	author := &discordgo.User{ID: "9393", Username: "wanderer", Discriminator: "0001"}
+	start := time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC)
+	indexedChannel, messages := persistTestMessages(t, db, author, start, []string{"here"}, []time.Duration{0})
+	otherChannel, err := ronnyd.PersistChannelToDB(db, "9393100", indexedChannel.GuildId)
+	assert.Nil(t, err)
+	moved, err := ronnyd.PersistMessageToDb(db, &discordgo.Message{
+		ID:        "9393101",
+		ChannelID: otherChannel.DiscordID,
+		Content:   "there",
+		Timestamp: start.Add(time.Minute),
+		Author:    author,
+	})
+	assert.Nil(t, err)
+	t.Cleanup(func() {
+		db.Unscoped().Delete(&ronnyd.Message{}, "channel_id = ?", otherChannel.ID)
+		db.Unscoped().Delete(otherChannel)
+	})
+	messages = append(messages, moved)
+
+	guild := &ronnyd.Guild{DiscordID: indexedChannel.GuildId, SessionGrouping: ronnyd.SESSION_GROUPING_SAME_CHANNEL}
+	for _, message := range messages {
+		assert.Nil(t, ronnyd.AddToPlaybackSession(db, guild, message))
+	}
+	stored := ronnyd.GetAuthor(db, author.ID)
+	assert.Len(t, ronnyd.GetPlaybackSessions(db, guild.DiscordID, stored.ID, ronnyd.PLAYBACK_SESSIONS_TO_LIST), 2)
+
+	// The default grouping doesn't mind moving channel
+	guild.SessionGrouping = ronnyd.SESSION_GROUPING_DEFAULT
+	assert.Nil(t, ronnyd.RebuildPlaybackSessions(db, guild, stored.ID))
+	sessions := ronnyd.GetPlaybackSessions(db, guild.DiscordID, stored.ID, ronnyd.PLAYBACK_SESSIONS_TO_LIST)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, 2, sessions[0].MessageCount)
+
+	// Replaying it where it was said needs playback in both channels
+	guild.AllowedPlaybackChannelIDs = []string{indexedChannel.DiscordID}
+	discordMock := new(MockedDiscord)
+	run, err := ronnyd.RunPlaybackRequest(discordMock, db, &ronnyd.PlaybackRequest{
+		TargetID:  author.ID,
+		Guild:     guild,
+		SessionID: sessions[0].ID,
+	})
+	defer db.Unscoped().Delete(run)
+	assert.IsType(t, &ronnyd.PlaybackBlockedError{}, err)
+	discordMock.AssertNotCalled(t, "ChannelMessageSendComplex", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestReactionCounts(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var indexedChannel ronnyd.Channel
+	db.First(&indexedChannel)
+	var adminAuthor ronnyd.Author
+	db.First(&adminAuthor, "discord_id = ?", os.Getenv("ADMIN_DISCORD_ID"))
+
+	discordMessage1 := &discordgo.Message{
+		ID:        "5678",
+		Content:   "banger",
+		ChannelID: fmt.Sprint(indexedChannel.DiscordID),
+		GuildID:   fmt.Sprint(indexedChannel.GuildId),
+		Timestamp: time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+		Author:    discordUser(&adminAuthor),
+	}
+	message1, err := ronnyd.PersistMessageToDb(db, discordMessage1)
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(&ronnyd.Message{}, "discord_id = ?", discordMessage1.ID)
+
+	fire := &discordgo.Emoji{Name: "🔥"}
+	ban := &discordgo.Emoji{Name: "BAN", ID: "862869222014976020"}
+	assert.Nil(t, ronnyd.AddReaction(db, discordMessage1.ID, "1", fire))
+	// Discord can send the same add twice
+	assert.Nil(t, ronnyd.AddReaction(db, discordMessage1.ID, "1", fire))
+	assert.Nil(t, ronnyd.AddReaction(db, discordMessage1.ID, "2", fire))
+	assert.Nil(t, ronnyd.AddReaction(db, discordMessage1.ID, "2", ban))
+	assert.Nil(t, ronnyd.RemoveReaction(db, discordMessage1.ID, "2", ban))
+
+	reactions := ronnyd.GetReactions(db, message1.ID)
+	assert.Len(t, reactions, 1)
+	assert.Equal(t, 2, reactions[0].Count)
+	assert.Len(t, reactions[0].Users, 2)
+
+	var stored ronnyd.Message
+	db.First(&stored, message1.ID)
+	assert.Equal(t, 2, stored.ReactionCount)
+
+	// Rescraping the message brings in reactions from while we were offline
+	discordMessage1.Reactions = []*discordgo.MessageReactions{
+		{Count: 5, Emoji: fire},
+		{Count: 3, Emoji: ban},
+	}
+	_, err = ronnyd.PersistMessageToDb(db, discordMessage1)
+	assert.Nil(t, err)
+	db.First(&stored, message1.ID)
+	assert.Equal(t, 8, stored.ReactionCount)
+	assert.Equal(t, 8, ronnyd.SessionReactionCount([]*ronnyd.Message{&stored}))
+
+	assert.Nil(t, ronnyd.RemoveAllReactions(db, discordMessage1.ID))
+	db.First(&stored, message1.ID)
+	assert.Equal(t, 0, stored.ReactionCount)
+	assert.Empty(t, ronnyd.GetReactions(db, message1.ID))
+}
@@ -0,0 +1,83 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"ronald-destroyer/ronnyd"
+)
+
+func discordUser(author *ronnyd.Author) *discordgo.User {
+	return &discordgo.User{
+		ID:            author.DiscordID,
+		Username:      author.Name,
+		Discriminator: author.Discriminator,
+	}
+}
+
+func TestReplyChain(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var indexedChannel ronnyd.Channel
+	db.First(&indexedChannel)
+	var adminAuthor ronnyd.Author
+	db.First(&adminAuthor, "discord_id = ?", os.Getenv("ADMIN_DISCORD_ID"))
+	var otherAuthor ronnyd.Author
+	db.First(&otherAuthor, "discord_id != ?", os.Getenv("ADMIN_DISCORD_ID"))
+
+	newDiscordMessage := func(id string, author *ronnyd.Author, content string, replyTo string) *discordgo.Message {
+		msg := &discordgo.Message{
+			ID:        id,
+			Content:   content,
+			ChannelID: fmt.Sprint(indexedChannel.DiscordID),
+			GuildID:   fmt.Sprint(indexedChannel.GuildId),
+			Timestamp: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC),
+			Author:    discordUser(author),
+		}
+		if replyTo != "" {
+			msg.MessageReference = &discordgo.MessageReference{MessageID: replyTo, ChannelID: msg.ChannelID}
+		}
+		return msg
+	}
+	root := newDiscordMessage("4567", &otherAuthor, "who wants pizza", "")
+	reply := newDiscordMessage("4568", &adminAuthor, "me", root.ID)
+	replyToReply := newDiscordMessage("4569", &otherAuthor, "ok", reply.ID)
+	defer db.Unscoped().Delete(&ronnyd.Message{}, "discord_id IN ?", []string{root.ID, reply.ID, replyToReply.ID})
+
+	// Scraping goes newest first, so replies show up before what they reference
+	_, err := ronnyd.PersistMessageToDb(db, replyToReply)
+	assert.Nil(t, err)
+	// Discord includes the referenced message with a reply
+	reply.ReferencedMessage = root
+	_, err = ronnyd.PersistMessageToDb(db, reply)
+	assert.Nil(t, err)
+
+	var lastMessage ronnyd.Message
+	db.First(&lastMessage, "discord_id = ?", replyToReply.ID)
+	chain := ronnyd.GetReplyChain(db, &lastMessage)
+	assert.Len(t, chain, 3)
+	assert.Equal(t, root.ID, chain[0].DiscordID)
+	assert.Equal(t, reply.ID, chain[1].DiscordID)
+	assert.Equal(t, replyToReply.ID, chain[2].DiscordID)
+
+	var replyMessage ronnyd.Message
+	db.Preload("ReferencedMessage.Author").First(&replyMessage, "discord_id = ?", reply.ID)
+	assert.Equal(t, fmt.Sprintf("> **%s**: who wants pizza\nme", otherAuthor.Name), ronnyd.PlaybackContent(&replyMessage))
+}
+
+func TestReplyQuoteKeepsCharactersWhole(t *testing.T) {
+	reply := &ronnyd.Message{
+		AuthorID: 1,
+		Content:  "same",
+		ReferencedMessage: &ronnyd.Message{
+			AuthorID: 2,
+			Author:   ronnyd.Author{Name: "quoted"},
+			Content:  strings.Repeat("日", 150),
+		},
+	}
+	assert.Equal(t, "> **quoted**: "+strings.Repeat("日", 100)+"...\nsame", ronnyd.PlaybackContent(reply))
+}
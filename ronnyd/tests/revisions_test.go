@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestFoldDuplicateMessages(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var indexedChannel ronnyd.Channel
+	db.First(&indexedChannel)
+	var author ronnyd.Author
+	db.First(&author)
+
+	// What the old edit handling left behind
+	original := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	edited := original.Add(time.Minute)
+	rows := []*ronnyd.Message{
+		{Content: "frist", MessageTimestamp: original, EditedAt: edited, DiscordID: "555", ChannelID: indexedChannel.ID, AuthorID: author.ID},
+		{Content: "first", MessageTimestamp: edited, DiscordID: "555", ChannelID: indexedChannel.ID, AuthorID: author.ID},
+	}
+	for _, row := range rows {
+		db.Create(row)
+	}
+	defer db.Unscoped().Delete(&ronnyd.Message{}, "discord_id = ?", "555")
+
+	folded, err := ronnyd.FoldDuplicateMessages(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, folded)
+
+	var messages []*ronnyd.Message
+	db.Find(&messages, "discord_id = ?", "555")
+	assert.Len(t, messages, 1)
+	assert.Equal(t, rows[0].ID, messages[0].ID)
+	assert.Equal(t, "first", messages[0].Content)
+	assert.True(t, messages[0].EditedAt.Equal(edited))
+
+	revisions := ronnyd.GetMessageRevisions(db, messages[0].ID)
+	assert.Len(t, revisions, 2)
+	assert.Equal(t, "frist", revisions[0].Content)
+	assert.Equal(t, "first", revisions[1].Content)
+	assert.Equal(t, *messages[0].CurrentRevisionID, revisions[1].ID)
+	db.Unscoped().Delete(&ronnyd.MessageRevision{}, "message_id = ?", messages[0].ID)
+}
+
+func TestFoldDuplicateMessagesKeepsExistingRevisions(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var indexedChannel ronnyd.Channel
+	db.First(&indexedChannel)
+	var author ronnyd.Author
+	db.First(&author)
+
+	// Revisions came in after the old edit handling had already left a
+	// duplicate behind, and the message was edited again since
+	original := time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)
+	edited := original.Add(time.Minute)
+	editedAgain := edited.Add(time.Minute)
+	rows := []*ronnyd.Message{
+		{Content: "secnod", MessageTimestamp: original, EditedAt: editedAgain, DiscordID: "556", ChannelID: indexedChannel.ID, AuthorID: author.ID},
+		{Content: "secon", MessageTimestamp: edited, DiscordID: "556", ChannelID: indexedChannel.ID, AuthorID: author.ID},
+	}
+	for _, row := range rows {
+		db.Create(row)
+	}
+	defer db.Unscoped().Delete(&ronnyd.Message{}, "discord_id = ?", "556")
+	existing := []*ronnyd.MessageRevision{
+		{MessageID: rows[0].ID, Revision: 0, Content: "secnod", RevisedAt: original},
+		{MessageID: rows[0].ID, Revision: 1, Content: "second", RevisedAt: editedAgain},
+	}
+	for _, revision := range existing {
+		db.Create(revision)
+	}
+	db.Model(rows[0]).Updates(map[string]interface{}{"content": "second", "current_revision_id": existing[1].ID})
+
+	folded, err := ronnyd.FoldDuplicateMessages(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, folded)
+
+	var message ronnyd.Message
+	db.First(&message, "discord_id = ?", "556")
+	assert.Equal(t, rows[0].ID, message.ID)
+	assert.Equal(t, "second", message.Content)
+	assert.True(t, message.EditedAt.Equal(editedAgain))
+
+	revisions := ronnyd.GetMessageRevisions(db, message.ID)
+	assert.Len(t, revisions, 3)
+	assert.Equal(t, existing[0].ID, revisions[0].ID)
+	assert.Equal(t, "secon", revisions[1].Content)
+	assert.True(t, revisions[1].RevisedAt.Equal(edited))
+	assert.Equal(t, existing[1].ID, revisions[2].ID)
+	assert.Equal(t, 2, revisions[2].Revision)
+	assert.Equal(t, *message.CurrentRevisionID, existing[1].ID)
+	db.Unscoped().Delete(&ronnyd.MessageRevision{}, "message_id = ?", message.ID)
+}
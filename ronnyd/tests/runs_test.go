@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestPlaybackRunIsRecorded(t *testing.T) {
+	useFakeClock(t)
+	db := ronnyd.ConnectToDB()
+	discordMock := new(MockedDiscord)
+	discordMock.On("ChannelMessageSendComplex", mock.Anything, mock.Anything).Return(nil, nil)
+
+	run, err := ronnyd.RunPlaybackRequest(discordMock, db, &ronnyd.PlaybackRequest{
+		TargetID:    os.Getenv("ADMIN_DISCORD_ID"),
+		Guild:       ronnyd.DefaultGuildSettings(),
+		TriggeredBy: "1234",
+	})
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(run)
+	for _, message := range run.Replayed {
+		defer db.Model(message).Update("replayed_at", time.Time{})
+	}
+	assert.NotEmpty(t, run.Replayed)
+
+	stored := ronnyd.GetPlaybackRun(db, run.ID)
+	assert.Equal(t, ronnyd.PLAYBACK_OUTCOME_COMPLETED, stored.Outcome)
+	assert.Equal(t, "1234", stored.TriggeredBy)
+	assert.Equal(t, run.Replayed[0].MessageTimestamp.Unix(), stored.SessionStart.Unix())
+	assert.Equal(t, run.Replayed[0].Channel.DiscordID, stored.DestinationChannelID)
+	assert.Len(t, stored.Items, len(run.Replayed))
+	assert.Equal(t, run.Replayed[0].ID, stored.Items[0].Message.ID)
+	assert.False(t, stored.FinishedAt.Before(stored.StartedAt))
+
+	assert.Equal(t, run.ID, ronnyd.GetPlaybackRuns(db, "", 1)[0].ID)
+	assert.Contains(t, ronnyd.FormatPlaybackRuns([]*ronnyd.PlaybackRun{stored}), "completed")
+}
+
+func TestUndoPlaybackRun(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var message ronnyd.Message
+	db.Preload("Channel").First(&message, "discord_id = ?", "1053070231075029074")
+	db.Model(&message).Update("replayed_at", time.Now())
+	defer db.Model(&message).Update("replayed_at", time.Time{})
+
+	run := &ronnyd.PlaybackRun{GuildID: "4444", Outcome: ronnyd.PLAYBACK_OUTCOME_COMPLETED, StartedAt: time.Now()}
+	db.Create(run)
+	defer db.Unscoped().Delete(run)
+	db.Create(&ronnyd.PlaybackItem{
+		PlaybackRunID: run.ID,
+		MessageID:     message.ID,
+		Status:        ronnyd.PLAYBACK_ITEM_SENT,
+		ChannelID:     message.Channel.DiscordID,
+		SentDiscordID: "5555",
+	})
+	run = ronnyd.GetLatestPlaybackRun(db, "4444")
+	assert.NotNil(t, run)
+
+	discordMock := new(MockedDiscord)
+	discordMock.On("ChannelMessageDelete", message.Channel.DiscordID, "5555").Return(nil)
+	deleted, err := ronnyd.UndoPlaybackRun(discordMock, db, run)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, deleted)
+	discordMock.AssertExpectations(t)
+
+	db.First(&message, message.ID)
+	assert.True(t, message.ReplayedAt.IsZero())
+	assert.Equal(t, ronnyd.PLAYBACK_OUTCOME_UNDONE, ronnyd.GetPlaybackRun(db, run.ID).Outcome)
+	assert.Nil(t, ronnyd.GetLatestPlaybackRun(db, "4444"))
+	_, err = ronnyd.UndoPlaybackRun(discordMock, db, run)
+	assert.NotNil(t, err)
+}
+
+type FlakyDiscord struct {
+	MockedDiscord
+}
+
+func (m *FlakyDiscord) ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error) {
+	args := m.Called(channelID, data)
+	return args.Get(0).(*discordgo.Message), args.Error(1)
+}
+
+func restError(status int) error {
+	return &discordgo.RESTError{Response: &http.Response{Status: http.StatusText(status), StatusCode: status, Header: http.Header{}}}
+}
+
+func TestPlaybackRetriesAndResumes(t *testing.T) {
+	useFakeClock(t)
+	db := ronnyd.ConnectToDB()
+	author := &discordgo.User{ID: "9191", Username: "flaky", Discriminator: "0001"}
+	indexedChannel, _ := persistTestMessages(
+		t, db, author,
+		time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC),
+		[]string{"first", "second"},
+		[]time.Duration{0, time.Minute},
+	)
+
+	discordMock := new(FlakyDiscord)
+	discordMock.On("ChannelMessageSendComplex", indexedChannel.DiscordID, sending("first")).Return((*discordgo.Message)(nil), restError(http.StatusBadGateway)).Once()
+	discordMock.On("ChannelMessageSendComplex", indexedChannel.DiscordID, sending("first")).Return(&discordgo.Message{ID: "1"}, nil).Once()
+	discordMock.On("ChannelMessageSendComplex", indexedChannel.DiscordID, sending("second")).Return((*discordgo.Message)(nil), restError(http.StatusForbidden)).Once()
+
+	run, err := ronnyd.RunPlaybackRequest(discordMock, db, &ronnyd.PlaybackRequest{
+		TargetID: author.ID,
+		Guild:    ronnyd.DefaultGuildSettings(),
+	})
+	assert.NotNil(t, err)
+	defer db.Unscoped().Delete(run)
+	// Forbidden isn't worth retrying
+	discordMock.AssertNumberOfCalls(t, "ChannelMessageSendComplex", 3)
+	assert.Len(t, run.Replayed, 1)
+	stored := ronnyd.GetPlaybackRun(db, run.ID)
+	assert.Equal(t, ronnyd.PLAYBACK_OUTCOME_PARTIAL, stored.Outcome)
+	assert.Equal(t, ronnyd.PLAYBACK_ITEM_SENT, stored.Items[0].Status)
+	assert.Equal(t, "1", stored.Items[0].SentDiscordID)
+	assert.Equal(t, ronnyd.PLAYBACK_ITEM_FAILED, stored.Items[1].Status)
+	assert.False(t, stored.Items[0].Message.ReplayedAt.IsZero())
+	assert.True(t, stored.Items[1].Message.ReplayedAt.IsZero())
+
+	// Pretend we were interrupted before the second message went out
+	db.Model(&stored.Items[1]).Update("status", ronnyd.PLAYBACK_ITEM_PENDING)
+	db.Model(stored).Update("outcome", ronnyd.PLAYBACK_OUTCOME_RUNNING)
+	discordMock.On("ChannelMessageSendComplex", indexedChannel.DiscordID, sending("second")).Return(&discordgo.Message{ID: "2"}, nil).Once()
+	resumed := ronnyd.ResumePlaybackRuns(discordMock, db)
+	assert.Len(t, resumed, 1)
+	stored = ronnyd.GetPlaybackRun(db, run.ID)
+	assert.Equal(t, ronnyd.PLAYBACK_OUTCOME_COMPLETED, stored.Outcome)
+	assert.Equal(t, "2", stored.Items[1].SentDiscordID)
+	assert.False(t, stored.Items[1].Message.ReplayedAt.IsZero())
+	discordMock.AssertExpectations(t)
+}
@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"ronald-destroyer/ronnyd"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+)
+
+const SCRAPE_TEST_CHANNEL = "900000000000000001"
+
+// FakeChannelHistory pages through an in-memory channel the way discord does
+type FakeChannelHistory struct {
+	MockedDiscord
+	history  []*discordgo.Message
+	requests int
+}
+
+func snowflake(message *discordgo.Message) uint64 {
+	id, _ := strconv.ParseUint(message.ID, 10, 64)
+	return id
+}
+
+func (f *FakeChannelHistory) ChannelMessages(channelID string, limit int, beforeID, afterID, aroundID string, options ...discordgo.RequestOption) ([]*discordgo.Message, error) {
+	f.requests++
+	page := make([]*discordgo.Message, 0, limit)
+	if beforeID != "" {
+		before, _ := strconv.ParseUint(beforeID, 10, 64)
+		for i := len(f.history) - 1; i >= 0 && len(page) < limit; i-- {
+			if snowflake(f.history[i]) < before {
+				page = append(page, f.history[i])
+			}
+		}
+		return page, nil
+	}
+	after, _ := strconv.ParseUint(afterID, 10, 64)
+	for i := 0; i < len(f.history) && len(page) < limit; i++ {
+		if snowflake(f.history[i]) > after {
+			page = append([]*discordgo.Message{f.history[i]}, page...)
+		}
+	}
+	return page, nil
+}
+
+func (f *FakeChannelHistory) addMessages(author *ronnyd.Author, count int) {
+	for i := 0; i < count; i++ {
+		n := len(f.history)
+		f.history = append(f.history, &discordgo.Message{
+			ID:        fmt.Sprint(900000000000001000 + n),
+			ChannelID: SCRAPE_TEST_CHANNEL,
+			Content:   fmt.Sprint("history ", n),
+			Timestamp: time.Date(2020, 1, 1, 0, n, 0, 0, time.UTC),
+			Author: &discordgo.User{
+				ID:            author.DiscordID,
+				Username:      author.Name,
+				Discriminator: author.Discriminator,
+			},
+		})
+	}
+}
+
+func cleanupScrapeTestChannel(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	channelID := ronnyd.IsChannelIndexed(db, SCRAPE_TEST_CHANNEL)
+	db.Unscoped().Delete(&ronnyd.Message{}, "channel_id = ?", channelID)
+	db.Unscoped().Delete(&ronnyd.ScrapeState{}, "channel_id = ?", channelID)
+	db.Unscoped().Delete(&ronnyd.Channel{}, "id = ?", channelID)
+}
+
+func TestScrapeResumesAndSkipsFetchedPages(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var adminAuthor ronnyd.Author
+	db.First(&adminAuthor, "discord_id = ?", os.Getenv("ADMIN_DISCORD_ID"))
+	_, err := ronnyd.PersistChannelToDB(db, SCRAPE_TEST_CHANNEL, "1")
+	assert.Nil(t, err)
+	defer cleanupScrapeTestChannel(t)
+
+	fake := &FakeChannelHistory{}
+	fake.addMessages(&adminAuthor, 250)
+	anchor := "900000000000002000"
+
+	state, err := ronnyd.ScrapeChannel(fake, db, SCRAPE_TEST_CHANNEL, 100, anchor, ronnyd.SCRAPE_BACKWARD)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, state.LastRunMessages)
+	assert.Equal(t, ronnyd.SCRAPE_STATUS_DONE, state.LastRunStatus)
+	assert.Equal(t, fake.history[150].ID, state.OldestDiscordID)
+	assert.Equal(t, fake.history[249].ID, state.NewestDiscordID)
+
+	state, err = ronnyd.ResumeChannelScrape(fake, db, SCRAPE_TEST_CHANNEL, 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, 150, state.LastRunMessages)
+	assert.Equal(t, ronnyd.SCRAPE_STATUS_REACHED_START, state.LastRunStatus)
+	assert.True(t, state.ReachedChannelStart)
+	assert.Equal(t, fake.history[0].ID, state.OldestDiscordID)
+
+	// Everything is already fetched, so we should stop after the first page
+	// lands inside the known range
+	fake.requests = 0
+	state, err = ronnyd.ScrapeChannel(fake, db, SCRAPE_TEST_CHANNEL, 1000, anchor, ronnyd.SCRAPE_BACKWARD)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fake.requests)
+	assert.Equal(t, ronnyd.SCRAPE_STATUS_REACHED_START, state.LastRunStatus)
+	// Messages we already had don't count towards the total again
+	assert.Equal(t, 250, state.TotalMessages)
+
+	var count int64
+	db.Model(&ronnyd.Message{}).Where("channel_id = ?", state.ChannelID).Count(&count)
+	assert.Equal(t, int64(250), count)
+
+	fake.addMessages(&adminAuthor, 30)
+	state, err = ronnyd.ScrapeChannel(fake, db, SCRAPE_TEST_CHANNEL, 1000, state.NewestDiscordID, ronnyd.SCRAPE_FORWARD)
+	assert.Nil(t, err)
+	assert.Equal(t, 30, state.LastRunMessages)
+	assert.Equal(t, ronnyd.SCRAPE_STATUS_CAUGHT_UP, state.LastRunStatus)
+	assert.Equal(t, fake.history[279].ID, state.NewestDiscordID)
+}
+
+func TestCatchUpChannelFetchesMissedMessages(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var adminAuthor ronnyd.Author
+	db.First(&adminAuthor, "discord_id = ?", os.Getenv("ADMIN_DISCORD_ID"))
+	channel, err := ronnyd.PersistChannelToDB(db, SCRAPE_TEST_CHANNEL, "1")
+	assert.Nil(t, err)
+	defer cleanupScrapeTestChannel(t)
+
+	fake := &FakeChannelHistory{}
+	fake.addMessages(&adminAuthor, 50)
+	_, err = ronnyd.ScrapeChannel(fake, db, SCRAPE_TEST_CHANNEL, 50, "900000000000002000", ronnyd.SCRAPE_BACKWARD)
+	assert.Nil(t, err)
+
+	// Pretend these were posted while the bot was offline
+	fake.addMessages(&adminAuthor, 2500)
+	newMessages, err := ronnyd.CatchUpChannel(fake, db, channel)
+	assert.Nil(t, err)
+	assert.Equal(t, 2500, newMessages)
+	assert.Equal(t, fake.history[2549].ID, ronnyd.GetNewestMessage(db, channel.ID).DiscordID)
+
+	newMessages, err = ronnyd.CatchUpChannel(fake, db, channel)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, newMessages)
+
+	// Replays fetched along the way aren't stored, so they aren't new messages
+	fake.addMessages(&adminAuthor, 5)
+	for _, message := range fake.history[2550:2553] {
+		message.WebhookID = "900000000000000002"
+	}
+	newMessages, err = ronnyd.CatchUpChannel(fake, db, channel)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, newMessages)
+
+	summary := ronnyd.CatchUpSummary([]ronnyd.CatchUpResult{{ChannelID: SCRAPE_TEST_CHANNEL, NewMessages: 2500}})
+	assert.Contains(t, summary, "2500 messages missed")
+}
@@ -0,0 +1,95 @@
+package tests
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestSessionSelectors(t *testing.T) {
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 12, 0, 0, 0, time.UTC)
+	}
+	// Oldest first, like GroupMessagesForPlayback's sessions once sorted
+	sessions := [][]*ronnyd.Message{
+		{{Content: "a", MessageTimestamp: day(2019, 6, 1)}},
+		{{Content: "b", MessageTimestamp: day(2020, 3, 14), ReactionCount: 50}},
+		{
+			{Content: "c", MessageTimestamp: day(2020, 6, 1)},
+			{Content: "c", MessageTimestamp: day(2020, 6, 1).Add(time.Minute)},
+			{Content: "c", MessageTimestamp: day(2020, 6, 1).Add(2 * time.Minute)},
+		},
+		{{Content: "d", MessageTimestamp: day(2021, 1, 1)}},
+	}
+	seeded := func() *rand.Rand {
+		return rand.New(rand.NewSource(1))
+	}
+	tests := []struct {
+		name     string
+		selector ronnyd.SessionSelector
+		expected string
+	}{
+		{"newest", &ronnyd.NewestSelector{}, "d"},
+		{"oldest", &ronnyd.OldestSelector{}, "a"},
+		{"longest", &ronnyd.LongestSelector{}, "c"},
+		{"weighted only picks weighted sessions", &ronnyd.WeightedSelector{Rand: seeded(), Weight: func(session []*ronnyd.Message) int {
+			if len(session) > 1 {
+				return 1
+			}
+			return 0
+		}}, "c"},
+		{"on this day picks the latest past year", &ronnyd.OnThisDaySelector{Now: day(2022, 6, 1)}, "c"},
+		{"on this day skips this year", &ronnyd.OnThisDaySelector{Now: day(2021, 1, 1)}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selected := test.selector.Select(sessions)
+			if test.expected == "" {
+				assert.Nil(t, selected)
+				return
+			}
+			assert.Equal(t, test.expected, selected[0].Content)
+		})
+	}
+
+	t.Run("random is repeatable with a seed", func(t *testing.T) {
+		first := (&ronnyd.RandomSelector{Rand: seeded()}).Select(sessions)
+		for i := 0; i < 5; i++ {
+			assert.Equal(t, first, (&ronnyd.RandomSelector{Rand: seeded()}).Select(sessions))
+		}
+	})
+
+	t.Run("weighted length favours long sessions", func(t *testing.T) {
+		selector, err := ronnyd.NewSessionSelector(ronnyd.SESSION_SELECTION_WEIGHTED_LENGTH, 1)
+		assert.Nil(t, err)
+		repeat, _ := ronnyd.NewSessionSelector(ronnyd.SESSION_SELECTION_WEIGHTED_LENGTH, 1)
+		picks := make(map[string]int)
+		for i := 0; i < 100; i++ {
+			selected := selector.Select(sessions)
+			assert.Equal(t, selected, repeat.Select(sessions))
+			picks[selected[0].Content]++
+		}
+		assert.Greater(t, picks["c"], picks["a"])
+		assert.Greater(t, picks["c"], picks["d"])
+	})
+
+	t.Run("reactions favour reacted sessions", func(t *testing.T) {
+		selector, err := ronnyd.NewSessionSelector(ronnyd.SESSION_SELECTION_REACTIONS, 1)
+		assert.Nil(t, err)
+		picks := make(map[string]int)
+		for i := 0; i < 100; i++ {
+			picks[selector.Select(sessions)[0].Content]++
+		}
+		assert.Greater(t, picks["b"], 50)
+	})
+
+	for _, name := range ronnyd.SESSION_SELECTIONS {
+		_, err := ronnyd.NewSessionSelector(name, 1)
+		assert.Nil(t, err)
+	}
+	_, err := ronnyd.NewSessionSelector("best", 1)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,202 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+	"ronald-destroyer/ronnyd"
+)
+
+func syntheticMessages(offsets []time.Duration, channels []uint) []*ronnyd.Message {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	messages := make([]*ronnyd.Message, 0, len(offsets))
+	for i, offset := range offsets {
+		messages = append(messages, &ronnyd.Message{
+			MessageTimestamp: start.Add(offset),
+			ChannelID:        channels[i],
+		})
+	}
+	return messages
+}
+
+func sessionLengths(sessions [][]*ronnyd.Message) []int {
+	lengths := make([]int, 0, len(sessions))
+	for _, session := range sessions {
+		lengths = append(lengths, len(session))
+	}
+	return lengths
+}
+
+func TestSessionGroupers(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	minutes := func(m ...int) []time.Duration {
+		offsets := make([]time.Duration, 0, len(m))
+		for _, minute := range m {
+			offsets = append(offsets, time.Duration(minute)*time.Minute)
+		}
+		return offsets
+	}
+	// Channel IDs no fixture uses, so nobody else ever speaks in between
+	quiet := []uint{9001, 9001, 9001, 9001, 9001, 9001}
+	tests := []struct {
+		name     string
+		grouper  ronnyd.SessionGrouper
+		offsets  []time.Duration
+		channels []uint
+		expected []int
+	}{
+		{"default caps sessions from their start", &ronnyd.DefaultGrouper{Gap: 5 * time.Minute}, minutes(0, 3, 6, 9), quiet, []int{2, 2}},
+		{"time gap only looks at the last message", &ronnyd.TimeGapGrouper{Gap: 5 * time.Minute}, minutes(0, 3, 6, 9, 20), quiet, []int{4, 1}},
+		{"max length cuts long sessions", &ronnyd.MaxLengthGrouper{Gap: 5 * time.Minute, MaxLength: 10 * time.Minute}, minutes(0, 4, 8, 12, 16, 30), quiet, []int{3, 2, 1}},
+		{"same channel splits on a channel change", &ronnyd.SameChannelGrouper{Gap: 5 * time.Minute}, minutes(0, 1, 2, 3), []uint{9001, 9001, 9002, 9001}, []int{2, 1, 1}},
+		{"reply chain is still split by gaps", &ronnyd.ReplyChainGrouper{Gap: 5 * time.Minute}, minutes(0, 4, 8, 20), quiet, []int{3, 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			messages := syntheticMessages(test.offsets, test.channels)
+			assert.Equal(t, test.expected, sessionLengths(test.grouper.Group(db, messages)))
+		})
+	}
+}
+
+func TestSessionGroupingsOverFixtures(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	guild := ronnyd.DefaultGuildSettings()
+	adminID := os.Getenv("ADMIN_DISCORD_ID")
+	var total int
+	for _, session := range ronnyd.GetGuildMessagesForPlayback(db, adminID, guild) {
+		total += len(session)
+	}
+	assert.NotZero(t, total)
+
+	for _, name := range ronnyd.SESSION_GROUPINGS {
+		t.Run(name, func(t *testing.T) {
+			grouper, err := ronnyd.NewSessionGrouper(name, guild)
+			assert.Nil(t, err)
+			sessions := ronnyd.GroupMessagesForPlayback(db, adminID, guild, grouper)
+			grouped := 0
+			for start, session := range sessions {
+				assert.Equal(t, start, session[0].MessageTimestamp)
+				grouped += len(session)
+				for i := 1; i < len(session); i++ {
+					assert.False(t, session[i].MessageTimestamp.Before(session[i-1].MessageTimestamp))
+					if name == ronnyd.SESSION_GROUPING_SAME_CHANNEL {
+						assert.Equal(t, session[0].ChannelID, session[i].ChannelID)
+					}
+					if name == ronnyd.SESSION_GROUPING_MAX_LENGTH {
+						assert.LessOrEqual(t, session[i].MessageTimestamp.Sub(session[0].MessageTimestamp), guild.MaxLength())
+					}
+				}
+			}
+			// Every grouping uses every message exactly once
+			assert.Equal(t, total, grouped)
+		})
+	}
+
+	_, err := ronnyd.NewSessionGrouper("alphabetical", guild)
+	assert.NotNil(t, err)
+}
+
+// insertConversation stores a channel where the target posts in bursts and
+// someone else interrupts every so often, returning a func to clean it up
+func insertConversation(db *gorm.DB, count int) (*ronnyd.Author, func()) {
+	target := &ronnyd.Author{DiscordID: "9393001", Name: "synthetic"}
+	other := &ronnyd.Author{DiscordID: "9393002", Name: "interrupter"}
+	db.Create(target)
+	db.Create(other)
+	channel := &ronnyd.Channel{DiscordID: "9393100"}
+	db.Create(channel)
+
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	messages := make([]*ronnyd.Message, 0, count)
+	for i := 0; i < count; i++ {
+		author := target
+		if i%7 == 3 {
+			author = other
+		}
+		if i%11 == 0 {
+			start = start.Add(10 * time.Minute)
+		} else {
+			start = start.Add(time.Minute)
+		}
+		messages = append(messages, &ronnyd.Message{
+			Content:          fmt.Sprint("synthetic ", i),
+			DiscordID:        fmt.Sprint(93930000 + i),
+			MessageTimestamp: start,
+			ChannelID:        channel.ID,
+			AuthorID:         author.ID,
+		})
+	}
+	db.Omit("Author", "Channel").CreateInBatches(messages, 1000)
+
+	return target, func() {
+		db.Unscoped().Delete(&ronnyd.Message{}, "channel_id = ?", channel.ID)
+		db.Unscoped().Delete(channel)
+		db.Unscoped().Delete(&ronnyd.Author{}, []uint{target.ID, other.ID})
+	}
+}
+
+// perMessageGrouper is the default grouping the way it used to be worked out,
+// with a query per message to look for interruptions
+type perMessageGrouper struct {
+	Gap time.Duration
+}
+
+func (grouper *perMessageGrouper) Group(db *gorm.DB, messages []*ronnyd.Message) [][]*ronnyd.Message {
+	var sessions [][]*ronnyd.Message
+	for _, message := range messages {
+		if len(sessions) > 0 {
+			start := sessions[len(sessions)-1][0].MessageTimestamp
+			var interruptions int64
+			db.Model(&ronnyd.Message{}).Where(
+				"channel_id = ? AND author_id != ? AND message_timestamp > ? AND message_timestamp < ?",
+				message.ChannelID, message.AuthorID, start, message.MessageTimestamp,
+			).Count(&interruptions)
+			if message.MessageTimestamp.Sub(start) <= grouper.Gap && interruptions == 0 {
+				sessions[len(sessions)-1] = append(sessions[len(sessions)-1], message)
+				continue
+			}
+		}
+		sessions = append(sessions, []*ronnyd.Message{message})
+	}
+	return sessions
+}
+
+func TestDefaultGrouperMatchesPerMessageGrouping(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	target, cleanup := insertConversation(db, 300)
+	defer cleanup()
+	guild := ronnyd.DefaultGuildSettings()
+
+	sessions := ronnyd.GroupMessagesForPlayback(db, target.DiscordID, guild, &ronnyd.DefaultGrouper{Gap: guild.Gap()})
+	assert.NotEmpty(t, sessions)
+	expected := ronnyd.GroupMessagesForPlayback(db, target.DiscordID, guild, &perMessageGrouper{Gap: guild.Gap()})
+	assert.Equal(t, len(expected), len(sessions))
+	for start, session := range expected {
+		assert.Equal(t, len(session), len(sessions[start]))
+	}
+}
+
+func BenchmarkSessionGrouping(b *testing.B) {
+	db := ronnyd.ConnectToDB()
+	guild := ronnyd.DefaultGuildSettings()
+	for _, count := range []int{1000, 20000} {
+		target, cleanup := insertConversation(db, count)
+		groupers := map[string]ronnyd.SessionGrouper{
+			"default":     &ronnyd.DefaultGrouper{Gap: guild.Gap()},
+			"per_message": &perMessageGrouper{Gap: guild.Gap()},
+		}
+		for name, grouper := range groupers {
+			b.Run(fmt.Sprintf("%s/%d", name, count), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					ronnyd.GroupMessagesForPlayback(db, target.DiscordID, guild, grouper)
+				}
+			})
+		}
+		cleanup()
+	}
+}
@@ -0,0 +1,169 @@
+package tests
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestThreadsOfIndexedChannelsAreIndexed(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var indexedChannel ronnyd.Channel
+	db.First(&indexedChannel)
+
+	thread := &discordgo.Channel{
+		ID:       "6789",
+		GuildID:  indexedChannel.GuildId,
+		ParentID: indexedChannel.DiscordID,
+		Name:     "pizza talk",
+		Type:     discordgo.ChannelTypeGuildPublicThread,
+	}
+	orphanThread := &discordgo.Channel{
+		ID:       "6790",
+		GuildID:  indexedChannel.GuildId,
+		ParentID: "not indexed",
+		Type:     discordgo.ChannelTypeGuildPublicThread,
+	}
+	threadID := ronnyd.IndexThreadIfParentIndexed(db, thread)
+	defer db.Unscoped().Delete(&ronnyd.Channel{}, "discord_id = ?", thread.ID)
+	assert.NotZero(t, threadID)
+	assert.Zero(t, ronnyd.IndexThreadIfParentIndexed(db, orphanThread))
+
+	var threadChannel ronnyd.Channel
+	db.First(&threadChannel, threadID)
+	assert.Equal(t, indexedChannel.ID, *threadChannel.ParentID)
+	assert.Equal(t, "pizza talk", threadChannel.Name)
+
+	discordMock := new(MockedDiscord)
+	discordMock.On("Channel", thread.ID).Return(thread, nil).Once()
+	destination, err := ronnyd.PlaybackChannelID(discordMock, db, &threadChannel)
+	assert.Nil(t, err)
+	assert.Equal(t, thread.ID, destination)
+
+	// Locked threads can't be posted in, so we start a new one
+	thread.ThreadMetadata = &discordgo.ThreadMetadata{Archived: true, Locked: true}
+	discordMock.On("Channel", thread.ID).Return(thread, nil).Once()
+	discordMock.On(
+		"ThreadStart",
+		indexedChannel.DiscordID,
+		"Replay: pizza talk",
+		discordgo.ChannelTypeGuildPublicThread,
+		ronnyd.REPLAY_THREAD_ARCHIVE_DURATION,
+	).Return(&discordgo.Channel{ID: "6791"}, nil)
+	destination, err = ronnyd.PlaybackChannelID(discordMock, db, &threadChannel)
+	assert.Nil(t, err)
+	assert.Equal(t, "6791", destination)
+	discordMock.AssertExpectations(t)
+}
+
+func TestLockedForumPostsAreReplayedInANewPost(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var indexedChannel ronnyd.Channel
+	db.First(&indexedChannel)
+	forum := &discordgo.Channel{
+		ID:      "6800",
+		GuildID: indexedChannel.GuildId,
+		Name:    "ideas",
+		Type:    discordgo.ChannelTypeGuildForum,
+	}
+	post := &discordgo.Channel{
+		ID:             "6801",
+		GuildID:        indexedChannel.GuildId,
+		ParentID:       forum.ID,
+		Name:           "pizza ideas",
+		Type:           discordgo.ChannelTypeGuildPublicThread,
+		ThreadMetadata: &discordgo.ThreadMetadata{Archived: true, Locked: true},
+	}
+	_, err := ronnyd.PersistDiscordChannelToDB(db, forum)
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(&ronnyd.Channel{}, "discord_id IN ?", []string{forum.ID, post.ID})
+	postChannel, err := ronnyd.PersistDiscordChannelToDB(db, post)
+	assert.Nil(t, err)
+
+	discordMock := new(MockedDiscord)
+	discordMock.On("Channel", post.ID).Return(post, nil)
+	discordMock.On(
+		"ForumThreadStart",
+		forum.ID,
+		"Replay: pizza ideas",
+		ronnyd.REPLAY_THREAD_ARCHIVE_DURATION,
+		"Replaying <#6801>",
+	).Return(&discordgo.Channel{ID: "6802"}, nil)
+	destination, err := ronnyd.PlaybackChannelID(discordMock, db, postChannel)
+	assert.Nil(t, err)
+	assert.Equal(t, "6802", destination)
+	discordMock.AssertNotCalled(t, "ThreadStart", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestForumsAreIndexedByNamingThem(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var indexedChannel ronnyd.Channel
+	db.First(&indexedChannel)
+	forum := &discordgo.Channel{
+		ID:      "6810",
+		GuildID: indexedChannel.GuildId,
+		Name:    "recipes",
+		Type:    discordgo.ChannelTypeGuildForum,
+	}
+	post := &discordgo.Channel{
+		ID:       "6811",
+		GuildID:  indexedChannel.GuildId,
+		ParentID: forum.ID,
+		Name:     "pizza dough",
+		Type:     discordgo.ChannelTypeGuildPublicThread,
+	}
+	defer db.Unscoped().Delete(&ronnyd.Channel{}, "discord_id IN ?", []string{forum.ID, post.ID})
+	defer db.Unscoped().Delete(&ronnyd.Message{}, "discord_id = ?", "68120")
+
+	discordMock := new(MockedDiscord)
+	discordMock.On("Channel", forum.ID).Return(forum, nil)
+	discordMock.On("GuildThreadsActive", forum.GuildID).Return(&discordgo.ThreadsList{Threads: []*discordgo.Channel{post}}, nil)
+	discordMock.On("ThreadsArchived", forum.ID, mock.Anything, mock.Anything).Return(&discordgo.ThreadsList{}, nil)
+	discordMock.On("ChannelMessages", post.ID, mock.Anything, "", "", "").Return([]*discordgo.Message{{
+		ID:        "68120",
+		ChannelID: post.ID,
+		GuildID:   post.GuildID,
+		Content:   "more water than you think",
+		Timestamp: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC),
+		Author:    &discordgo.User{ID: os.Getenv("ADMIN_DISCORD_ID")},
+	}}, nil)
+	discordMock.On("ChannelMessageSendComplex", "1", mock.Anything).Return(nil, nil)
+	ctx := &ronnyd.CommandContext{
+		Session:   discordMock,
+		DB:        db,
+		Guild:     ronnyd.DefaultGuildSettings(),
+		GuildID:   forum.GuildID,
+		ChannelID: "1",
+		AuthorID:  os.Getenv("ADMIN_DISCORD_ID"),
+	}
+	assert.Nil(t, ronnyd.Commands.Dispatch(ctx, "index 10 <#6810>"))
+	assertReplied(t, discordMock, "Indexed 1 posts in <#6810>")
+	defer func() {
+		for _, channelID := range []string{forum.ID, post.ID} {
+			db.Unscoped().Delete(&ronnyd.ScrapeState{}, "channel_id = ?", ronnyd.IsChannelIndexed(db, channelID))
+		}
+	}()
+
+	var message ronnyd.Message
+	db.Preload("Channel").First(&message, "discord_id = ?", "68120")
+	assert.Equal(t, "more water than you think", message.Content)
+
+	// Once the post is locked its messages are replayed in a new one
+	post.ThreadMetadata = &discordgo.ThreadMetadata{Archived: true, Locked: true}
+	discordMock.On("Channel", post.ID).Return(post, nil)
+	discordMock.On(
+		"ForumThreadStart",
+		forum.ID,
+		"Replay: pizza dough",
+		ronnyd.REPLAY_THREAD_ARCHIVE_DURATION,
+		"Replaying <#6811>",
+	).Return(&discordgo.Channel{ID: "6812"}, nil)
+	destination, err := ronnyd.PlaybackChannelID(discordMock, db, &message.Channel)
+	assert.Nil(t, err)
+	assert.Equal(t, "6812", destination)
+}
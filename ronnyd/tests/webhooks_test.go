@@ -0,0 +1,92 @@
+package tests
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"ronald-destroyer/ronnyd"
+)
+
+func TestWebhookPlayback(t *testing.T) {
+	useFakeClock(t)
+	db := ronnyd.ConnectToDB()
+	author := &discordgo.User{ID: "9494", Username: "webhooked", Discriminator: "0001", Avatar: "abc123"}
+	indexedChannel, _ := persistTestMessages(
+		t, db, author,
+		time.Date(2020, 8, 1, 12, 0, 0, 0, time.UTC),
+		[]string{"webhook 0", "webhook 1"},
+		[]time.Duration{0, time.Minute},
+	)
+	guild := &ronnyd.Guild{PlaybackDelivery: ronnyd.PLAYBACK_DELIVERY_WEBHOOK}
+
+	asAuthor := mock.MatchedBy(func(params *discordgo.WebhookParams) bool {
+		return params.Username == "webhooked" && strings.Contains(params.AvatarURL, "abc123") &&
+			params.AllowedMentions != nil && len(params.AllowedMentions.Parse) == 0
+	})
+	discordMock := new(MockedDiscord)
+	discordMock.On("Channel", indexedChannel.DiscordID).Return(&discordgo.Channel{ID: indexedChannel.DiscordID, Type: discordgo.ChannelTypeGuildText}, nil)
+	discordMock.On("ChannelWebhooks", indexedChannel.DiscordID).Return([]*discordgo.Webhook{}, nil)
+	discordMock.On("WebhookCreate", indexedChannel.DiscordID, ronnyd.PLAYBACK_WEBHOOK_NAME, "").Return(&discordgo.Webhook{ID: "77", Token: "token"}, nil).Once()
+	discordMock.On("WebhookExecute", "77", "token", true, asAuthor).Return(&discordgo.Message{ID: "8001"}, nil)
+
+	run, err := ronnyd.RunPlaybackRequest(discordMock, db, &ronnyd.PlaybackRequest{TargetID: author.ID, Guild: guild})
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(run)
+	assert.Len(t, run.Replayed, 2)
+	discordMock.AssertNumberOfCalls(t, "WebhookCreate", 1)
+	discordMock.AssertNotCalled(t, "ChannelMessageSendComplex", mock.Anything, mock.Anything)
+	stored := ronnyd.GetPlaybackRun(db, run.ID)
+	assert.Equal(t, ronnyd.PLAYBACK_DELIVERY_WEBHOOK, stored.Delivery)
+	assert.Equal(t, "77", stored.Items[0].WebhookID)
+
+	discordMock.On("WebhookMessageDelete", "77", "token", "8001").Return(nil)
+	deleted, err := ronnyd.UndoPlaybackRun(discordMock, db, stored)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, deleted)
+	discordMock.AssertNotCalled(t, "ChannelMessageDelete", mock.Anything, mock.Anything)
+
+	// Without Manage Webhooks we replay as the bot instead
+	db.Unscoped().Delete(&ronnyd.PlaybackWebhook{}, "channel_id = ?", indexedChannel.DiscordID)
+	forbidden := new(MockedDiscord)
+	forbidden.On("Channel", indexedChannel.DiscordID).Return(&discordgo.Channel{ID: indexedChannel.DiscordID, Type: discordgo.ChannelTypeGuildText}, nil)
+	forbidden.On("ChannelWebhooks", indexedChannel.DiscordID).Return([]*discordgo.Webhook(nil), restError(http.StatusForbidden))
+	pingsNobody := mock.MatchedBy(func(data *discordgo.MessageSend) bool {
+		return data.AllowedMentions != nil && len(data.AllowedMentions.Parse) == 0
+	})
+	forbidden.On("ChannelMessageSendComplex", indexedChannel.DiscordID, pingsNobody).Return(nil, nil)
+	run, err = ronnyd.RunPlaybackRequest(forbidden, db, &ronnyd.PlaybackRequest{TargetID: author.ID, Guild: guild})
+	assert.Nil(t, err)
+	defer db.Unscoped().Delete(run)
+	assert.Len(t, run.Replayed, 2)
+	forbidden.AssertNumberOfCalls(t, "ChannelWebhooks", 1)
+	forbidden.AssertNumberOfCalls(t, "ChannelMessageSendComplex", 2)
+	assert.Empty(t, ronnyd.GetPlaybackRun(db, run.ID).Items[0].WebhookID)
+}
+
+func TestReplaysThroughWebhooksAreNotArchived(t *testing.T) {
+	db := ronnyd.ConnectToDB()
+	var indexedChannel ronnyd.Channel
+	db.First(&indexedChannel)
+	state := discordgo.NewState()
+	state.User = &discordgo.User{ID: "bot"}
+
+	// How one of our replays comes back to us, posted as its author
+	ronnyd.MessageHandler(&discordgo.Session{State: state}, &discordgo.MessageCreate{Message: &discordgo.Message{
+		ID:        "9495001",
+		ChannelID: indexedChannel.DiscordID,
+		GuildID:   indexedChannel.GuildId,
+		WebhookID: "9495",
+		Content:   "replayed",
+		Timestamp: time.Now(),
+		Author:    &discordgo.User{ID: "9495", Username: "webhooked", Bot: true},
+	}})
+	var count int64
+	db.Model(&ronnyd.Message{}).Where("discord_id = ?", "9495001").Count(&count)
+	assert.Zero(t, count)
+	assert.Nil(t, ronnyd.GetAuthor(db, "9495"))
+}
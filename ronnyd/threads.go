@@ -0,0 +1,163 @@
+package ronnyd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+// How long replay threads we create stay open, in minutes
+const REPLAY_THREAD_ARCHIVE_DURATION = 1440
+
+func IsThread(channelType discordgo.ChannelType) bool {
+	return channelType == discordgo.ChannelTypeGuildPublicThread ||
+		channelType == discordgo.ChannelTypeGuildPrivateThread ||
+		channelType == discordgo.ChannelTypeGuildNewsThread
+}
+
+// PersistDiscordChannelToDB stores a channel along with what we know about it
+// from discord, keeping an existing row's details up to date
+func PersistDiscordChannelToDB(db *gorm.DB, discordChannel *discordgo.Channel) (*Channel, error) {
+	channel, err := PersistChannelToDB(db, discordChannel.ID, discordChannel.GuildID)
+	if err != nil {
+		return nil, err
+	}
+	channel.Name = discordChannel.Name
+	channel.Type = int(discordChannel.Type)
+	if discordChannel.ThreadMetadata != nil {
+		channel.Archived = discordChannel.ThreadMetadata.Archived
+		channel.Locked = discordChannel.ThreadMetadata.Locked
+	}
+	if discordChannel.ParentID != "" {
+		parentID := IsChannelIndexed(db, discordChannel.ParentID)
+		if parentID != 0 {
+			channel.ParentID = &parentID
+		}
+	}
+	result := db.Save(channel)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return channel, nil
+}
+
+// IndexThreadIfParentIndexed indexes threads started in channels we index,
+// returning the thread's channel ID, or 0 if it shouldn't be indexed
+func IndexThreadIfParentIndexed(db *gorm.DB, thread *discordgo.Channel) uint {
+	if channelID := IsChannelIndexed(db, thread.ID); channelID != 0 {
+		return channelID
+	}
+	if !IsThread(thread.Type) || IsChannelIndexed(db, thread.ParentID) == 0 {
+		return 0
+	}
+	channel, err := PersistDiscordChannelToDB(db, thread)
+	if err != nil {
+		log.Default().Println("Error indexing thread", thread.ID, err)
+		return 0
+	}
+	log.Default().Println("Indexed thread", thread.ID, thread.Name, "in", thread.ParentID)
+	return channel.ID
+}
+
+// ListChannelThreads finds the active and public archived threads that were
+// started in a channel
+func ListChannelThreads(s Discord, guildID string, channelID string) ([]*discordgo.Channel, error) {
+	var threads []*discordgo.Channel
+	active, err := s.GuildThreadsActive(guildID)
+	if err != nil {
+		return nil, err
+	}
+	for _, thread := range active.Threads {
+		if thread.ParentID == channelID {
+			threads = append(threads, thread)
+		}
+	}
+
+	var before *discordgo.Channel
+	for {
+		var beforeTimestamp *time.Time
+		if before != nil && before.ThreadMetadata != nil {
+			beforeTimestamp = &before.ThreadMetadata.ArchiveTimestamp
+		}
+		archived, err := s.ThreadsArchived(channelID, beforeTimestamp, 100)
+		if err != nil {
+			return threads, err
+		}
+		threads = append(threads, archived.Threads...)
+		if !archived.HasMore || len(archived.Threads) == 0 {
+			return threads, nil
+		}
+		before = archived.Threads[len(archived.Threads)-1]
+	}
+}
+
+// ScrapeChannelThreads indexes every thread started in the channel and
+// scrapes up to maxMessages from each of them
+func ScrapeChannelThreads(s Discord, db *gorm.DB, guildID string, channelID string, maxMessages int) (int, error) {
+	threads, err := ListChannelThreads(s, guildID, channelID)
+	if err != nil {
+		return 0, err
+	}
+	scraped := 0
+	for _, thread := range threads {
+		if IndexThreadIfParentIndexed(db, thread) == 0 {
+			continue
+		}
+		_, err := ResumeChannelScrape(s, db, thread.ID, maxMessages)
+		if errors.Is(err, ErrNothingIndexed) {
+			// New to us, so start from the latest message
+			_, err = ScrapeChannel(s, db, thread.ID, maxMessages, "", SCRAPE_BACKWARD)
+		}
+		if err != nil {
+			log.Default().Println("Error scraping thread", thread.ID, err)
+			continue
+		}
+		scraped++
+	}
+	return scraped, nil
+}
+
+// PlaybackChannelID works out where to replay messages from a channel.
+// Threads are replayed into the original thread while it can still be posted
+// in, otherwise into a new thread in the parent channel.
+func PlaybackChannelID(s Discord, db *gorm.DB, channel *Channel) (string, error) {
+	if channel.ParentID == nil {
+		return channel.DiscordID, nil
+	}
+	thread, err := s.Channel(channel.DiscordID)
+	// Posting in an archived thread reopens it, unless it's been locked
+	if err == nil && (thread.ThreadMetadata == nil || !thread.ThreadMetadata.Locked) {
+		return thread.ID, nil
+	}
+
+	var parent Channel
+	db.First(&parent, *channel.ParentID)
+	if parent.ID == 0 {
+		return "", fmt.Errorf("parent of thread %s is missing", channel.DiscordID)
+	}
+	var replayThread *discordgo.Channel
+	if discordgo.ChannelType(parent.Type) == discordgo.ChannelTypeGuildForum {
+		// Forum posts can't be started without a message
+		replayThread, err = s.ForumThreadStart(
+			parent.DiscordID,
+			"Replay: "+channel.Name,
+			REPLAY_THREAD_ARCHIVE_DURATION,
+			"Replaying <#"+channel.DiscordID+">",
+		)
+	} else {
+		replayThread, err = s.ThreadStart(
+			parent.DiscordID,
+			"Replay: "+channel.Name,
+			discordgo.ChannelTypeGuildPublicThread,
+			REPLAY_THREAD_ARCHIVE_DURATION,
+		)
+	}
+	if err != nil {
+		return "", err
+	}
+	return replayThread.ID, nil
+}
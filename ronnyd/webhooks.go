@@ -0,0 +1,172 @@
+package ronnyd
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bwmarrin/discordgo"
+	"gorm.io/gorm"
+)
+
+const (
+	// Replays are sent by the bot account
+	PLAYBACK_DELIVERY_BOT = "bot"
+	// Replays are sent through a channel webhook, looking like the author
+	PLAYBACK_DELIVERY_WEBHOOK = "webhook"
+)
+
+var PLAYBACK_DELIVERIES = []string{PLAYBACK_DELIVERY_BOT, PLAYBACK_DELIVERY_WEBHOOK}
+
+// What we call the webhooks we make, so we can find them again
+const PLAYBACK_WEBHOOK_NAME = "Ronald Destroyer Playback"
+
+// PlaybackWebhook is the webhook we post replays through in a channel. Threads
+// use their parent channel's webhook.
+type PlaybackWebhook struct {
+	gorm.Model
+	ChannelID string `gorm:"uniqueIndex"`
+	WebhookID string `gorm:"index"`
+	Token     string
+}
+
+func isForbidden(err error) bool {
+	var restErr *discordgo.RESTError
+	return errors.As(err, &restErr) && restErr.Response != nil && restErr.Response.StatusCode == http.StatusForbidden
+}
+
+// GetPlaybackWebhook reuses the webhook we stored or made earlier for the
+// channel, and makes one if there isn't one
+func GetPlaybackWebhook(s Discord, db *gorm.DB, channelID string) (*PlaybackWebhook, error) {
+	var webhook PlaybackWebhook
+	db.Limit(1).Find(&webhook, "channel_id = ?", channelID)
+	if webhook.ID != 0 {
+		return &webhook, nil
+	}
+	webhook.ChannelID = channelID
+
+	existing, err := s.ChannelWebhooks(channelID)
+	if err != nil {
+		return nil, err
+	}
+	for _, candidate := range existing {
+		if candidate.Name == PLAYBACK_WEBHOOK_NAME && candidate.Token != "" {
+			webhook.WebhookID = candidate.ID
+			webhook.Token = candidate.Token
+			break
+		}
+	}
+	if webhook.WebhookID == "" {
+		created, err := s.WebhookCreate(channelID, PLAYBACK_WEBHOOK_NAME, "")
+		if err != nil {
+			return nil, err
+		}
+		webhook.WebhookID = created.ID
+		webhook.Token = created.Token
+	}
+	result := db.Create(&webhook)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return &webhook, nil
+}
+
+// forgetPlaybackWebhook drops a stored webhook someone has deleted, so the
+// next playback makes a new one
+func forgetPlaybackWebhook(db *gorm.DB, webhook *PlaybackWebhook) {
+	db.Unscoped().Delete(webhook)
+}
+
+func getPlaybackWebhookByID(db *gorm.DB, webhookID string) *PlaybackWebhook {
+	var webhook PlaybackWebhook
+	db.Limit(1).Find(&webhook, "webhook_id = ?", webhookID)
+	if webhook.ID == 0 {
+		return nil
+	}
+	return &webhook
+}
+
+// playbackTarget is where one replayed message goes. Webhook is nil when
+// sending as the bot.
+type playbackTarget struct {
+	ChannelID string
+	Webhook   *PlaybackWebhook
+	// Set when ChannelID is a thread, since webhooks belong to its parent
+	ThreadID string
+}
+
+// playbackWebhooks finds the webhook for each destination during a playback,
+// remembering the channels where we have to fall back to sending as the bot
+type playbackWebhooks struct {
+	session Discord
+	db      *gorm.DB
+	targets map[string]*playbackTarget
+}
+
+func newPlaybackWebhooks(s Discord, db *gorm.DB) *playbackWebhooks {
+	return &playbackWebhooks{session: s, db: db, targets: make(map[string]*playbackTarget)}
+}
+
+func (webhooks *playbackWebhooks) target(destination string) *playbackTarget {
+	if target, ok := webhooks.targets[destination]; ok {
+		return target
+	}
+	target := &playbackTarget{ChannelID: destination}
+	webhooks.targets[destination] = target
+
+	webhookChannelID := destination
+	channel, err := webhooks.session.Channel(destination)
+	if err == nil && IsThread(channel.Type) {
+		webhookChannelID = channel.ParentID
+		target.ThreadID = destination
+	}
+	target.Webhook, err = GetPlaybackWebhook(webhooks.session, webhooks.db, webhookChannelID)
+	if err != nil {
+		if !isForbidden(err) {
+			fmt.Println("Unable to get playback webhook", webhookChannelID, err)
+		} else {
+			fmt.Println("Missing Manage Webhooks, replaying as the bot", webhookChannelID)
+		}
+		target.Webhook = nil
+	}
+	return target
+}
+
+// playbackIdentity is the name and avatar the author had, for posting as them
+func playbackIdentity(db *gorm.DB, message *Message, guildID string) (string, string) {
+	author := &message.Author
+	// Their nickname here, or the display name they picked for everywhere
+	name := GetAuthorNickname(db, author.ID, guildID)
+	if name == "" {
+		name = author.Nickname
+	}
+	if name == "" {
+		name = author.Name
+	}
+	user := &discordgo.User{ID: author.DiscordID, Avatar: author.Avatar, Discriminator: author.Discriminator}
+	return name, user.AvatarURL("")
+}
+
+// executePlaybackWebhook posts the message as its author
+func executePlaybackWebhook(s Discord, db *gorm.DB, target *playbackTarget, message *Message, data *discordgo.MessageSend) (*discordgo.Message, error) {
+	username, avatarURL := playbackIdentity(db, message, message.Channel.GuildId)
+	params := &discordgo.WebhookParams{
+		Content:   data.Content,
+		Username:  username,
+		AvatarURL: avatarURL,
+		Files:     data.Files,
+		// Same as replaying as the bot, nobody gets pinged
+		AllowedMentions: data.AllowedMentions,
+	}
+	var sent *discordgo.Message
+	var err error
+	if target.ThreadID != "" {
+		sent, err = s.WebhookThreadExecute(target.Webhook.WebhookID, target.Webhook.Token, true, target.ThreadID, params)
+	} else {
+		sent, err = s.WebhookExecute(target.Webhook.WebhookID, target.Webhook.Token, true, params)
+	}
+	if isNotFound(err) {
+		forgetPlaybackWebhook(db, target.Webhook)
+	}
+	return sent, err
+}